@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	libparodus "github.com/xmidt-org/go-parodus/client"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// PartnerIDPolicy rejects the messages that are not for the partner of
+	// the device. With partner-id:allow-empty, messages without partner ids
+	// are accepted, like the C parodus does.
+	PartnerIDPolicy = "partner-id"
+
+	partnerIDAllowEmpty = "allow-empty"
+
+	// SourcePolicy rejects the messages whose source does not match the
+	// regular expression given with it, like source:^dns:webpa\.
+	SourcePolicy = "source"
+
+	// DestinationPolicy rejects the messages whose destination does not
+	// match the regular expression given with it.
+	DestinationPolicy = "destination"
+)
+
+var (
+	errSourceNotAllowed      = errors.New("source is not allowed")
+	errDestinationNotAllowed = errors.New("destination is not allowed")
+)
+
+// authorizationPolicies builds each policy an operator can list in
+// --authorization-policy from the argument after its name.
+var authorizationPolicies = map[string]func(config Config, arg string, logger *zap.Logger) (libparodus.AllowMessage, error){
+	PartnerIDPolicy:   partnerIDPolicy,
+	SourcePolicy:      matchPolicy(func(msg wrp.Message) string { return msg.Source }, errSourceNotAllowed),
+	DestinationPolicy: matchPolicy(func(msg wrp.Message) string { return msg.Destination }, errDestinationNotAllowed),
+}
+
+// authorizer is the chain of policies a request from the cloud has to pass
+// before it is delivered to a local service. The first policy to reject the
+// request decides. Events and answers are not checked.
+type authorizer []libparodus.AllowMessage
+
+func newAuthorizer(config Config, logger *zap.Logger) (authorizer, error) {
+	var chain authorizer
+	for _, policy := range config.AuthorizationPolicies {
+		name, arg, _ := strings.Cut(policy, ":")
+		build, ok := authorizationPolicies[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown policy %q", AuthorizationPolicyKeyName, name)
+		}
+		allow, err := build(config, arg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", AuthorizationPolicyKeyName, name, err)
+		}
+		chain = append(chain, allow)
+	}
+	return chain, nil
+}
+
+// Allow runs the message through every policy.
+func (a authorizer) Allow(msg wrp.Message) error {
+	for _, policy := range a {
+		if err := policy.Allow(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partnerIDPolicy uses client.BlockByPartnerID. A device without a partner id
+// accepts messages for any partner. A message without partner ids is only
+// accepted when the policy is given allow-empty.
+func partnerIDPolicy(config Config, arg string, logger *zap.Logger) (libparodus.AllowMessage, error) {
+	if arg != "" && arg != partnerIDAllowEmpty {
+		return nil, fmt.Errorf("unknown option %q", arg)
+	}
+	if config.PartnerID == "" {
+		logger.Warn("no partner id set, messages for any partner are accepted", zap.String("policy", PartnerIDPolicy))
+		return libparodus.AllowMessageFunc(func(wrp.Message) error { return nil }), nil
+	}
+	block := libparodus.BlockByPartnerID(config.PartnerID)
+	if arg != partnerIDAllowEmpty {
+		return block, nil
+	}
+	return libparodus.AllowMessageFunc(func(msg wrp.Message) error {
+		if len(msg.PartnerIDs) == 0 {
+			return nil
+		}
+		return block(msg)
+	}), nil
+}
+
+func matchPolicy(field func(wrp.Message) string, rejected error) func(Config, string, *zap.Logger) (libparodus.AllowMessage, error) {
+	return func(_ Config, arg string, _ *zap.Logger) (libparodus.AllowMessage, error) {
+		if arg == "" {
+			return nil, errors.New("a regular expression must follow the policy name")
+		}
+		allowed, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return libparodus.AllowMessageFunc(func(msg wrp.Message) error {
+			if !allowed.MatchString(field(msg)) {
+				return rejected
+			}
+			return nil
+		}), nil
+	}
+}
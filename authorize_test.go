@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	libparodus "github.com/xmidt-org/go-parodus/client"
+	"github.com/xmidt-org/kratos"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+func TestPartnerIDPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		arg        string
+		partnerIDs []string
+		allowed    bool
+	}{
+		{"device partner", "", []string{"sky", "comcast"}, true},
+		{"other partner", "", []string{"sky"}, false},
+		{"no partner ids", "", nil, false},
+		{"no partner ids allowed", partnerIDAllowEmpty, nil, true},
+		{"other partner with empty allowed", partnerIDAllowEmpty, []string{"sky"}, false},
+	}
+	for _, test := range tests {
+		allow, err := partnerIDPolicy(Config{PartnerID: "comcast"}, test.arg, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = allow.Allow(wrp.Message{Type: wrp.SimpleRequestResponseMessageType, PartnerIDs: test.partnerIDs})
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, err)
+		}
+	}
+
+	if _, err := partnerIDPolicy(Config{PartnerID: "comcast"}, "allow-all", zap.NewNop()); err == nil {
+		t.Error("expected an unknown option to be refused")
+	}
+}
+
+// recordingHandler hands every message it gets to handled.
+type recordingHandler chan *wrp.Message
+
+func (h recordingHandler) HandleMessage(msg *wrp.Message) *wrp.Message {
+	h <- msg
+	return nil
+}
+
+func (h recordingHandler) Close() {}
+
+func TestOnlyRequestsAreAuthorized(t *testing.T) {
+	registry, err := kratos.NewHandlerRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(recordingHandler, 10)
+	if err := registry.Add(servicePattern("config"), handled); err != nil {
+		t.Fatal(err)
+	}
+	buffers, err := parseBufferConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := ProvideUpstreamRequests()
+	u := &Upstream{
+		logger:   zap.NewNop(),
+		registry: registry,
+		requests: requests,
+		self:     ProvideSelfHandler(),
+		authorize: authorizer{libparodus.AllowMessageFunc(func(wrp.Message) error {
+			return libparodus.ErrInvalidPartnerID
+		})},
+		buffer:     newOutboundBuffer(buffers),
+		downstream: make(chan *wrp.Message, 10),
+		done:       make(chan struct{}),
+	}
+	u.wg.Add(1)
+	go u.handleDownstream()
+	defer func() {
+		close(u.done)
+		u.wg.Wait()
+	}()
+
+	requests.Add(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent"})
+	status := int64(200)
+	u.downstream <- &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "new", Destination: "mac:112233445566/config"}
+	u.downstream <- &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "mac:112233445566/config/event"}
+	u.downstream <- &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent", Destination: "mac:112233445566/config"}
+	// a status alone does not make an answer, and a request is answered once
+	u.downstream <- &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "answer", Status: &status,
+		Destination: "mac:112233445566/config"}
+	u.downstream <- &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent", Destination: "mac:112233445566/config"}
+
+	for _, want := range []wrp.MessageType{wrp.SimpleEventMessageType, wrp.SimpleRequestResponseMessageType} {
+		select {
+		case msg := <-handled:
+			if msg.Type != want || (msg.TransactionUUID != "" && msg.TransactionUUID != "sent") {
+				t.Fatalf("unexpected message %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("an event or an answer was not delivered")
+		}
+	}
+	for _, transactionUUID := range []string{"new", "answer", "sent"} {
+		deadline := time.Now().Add(time.Second)
+		for u.buffer.Len() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		rejection := u.buffer.Peek()
+		if rejection == nil || rejection.TransactionUUID != transactionUUID || rejection.Status == nil || *rejection.Status != 403 {
+			t.Fatalf("expected a 403 for %s, got %+v", transactionUUID, rejection)
+		}
+		u.buffer.Pop()
+	}
+	select {
+	case msg := <-handled:
+		t.Fatalf("unexpected message %+v", msg)
+	default:
+	}
+}
@@ -0,0 +1,219 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// DropPolicy decides which message is lost when a full buffer gets another one.
+type DropPolicy string
+
+const (
+	DropOldest DropPolicy = "oldest"
+	DropNewest DropPolicy = "newest"
+)
+
+// BufferConfig bounds the outbound buffer of one QoS level.
+type BufferConfig struct {
+	Size   int
+	Policy DropPolicy
+}
+
+var (
+	qosLevels = []wrp.QOSLevel{wrp.QOSLow, wrp.QOSMedium, wrp.QOSHigh, wrp.QOSCritical}
+
+	defaultBufferSizes = map[string]int{
+		"low":      100,
+		"medium":   100,
+		"high":     100,
+		"critical": 100,
+	}
+	defaultDropPolicies = map[string]string{
+		"low":      string(DropOldest),
+		"medium":   string(DropOldest),
+		"high":     string(DropOldest),
+		"critical": string(DropOldest),
+	}
+)
+
+// parseBufferConfig builds the per QoS buffer limits from the flag values,
+// using the defaults for any level that is left out.
+func parseBufferConfig(sizes map[string]int, policies map[string]string) (map[wrp.QOSLevel]BufferConfig, error) {
+	levels := make(map[string]wrp.QOSLevel, len(qosLevels))
+	for _, level := range qosLevels {
+		levels[strings.ToLower(level.String())] = level
+	}
+
+	buffers := make(map[wrp.QOSLevel]BufferConfig, len(qosLevels))
+	for name, level := range levels {
+		buffers[level] = BufferConfig{Size: defaultBufferSizes[name], Policy: DropPolicy(defaultDropPolicies[name])}
+	}
+	for name, size := range sizes {
+		level, ok := levels[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown qos level %s", OutboundBufferSizeKeyName, name)
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("%s: size for %s must not be negative", OutboundBufferSizeKeyName, name)
+		}
+		buffer := buffers[level]
+		buffer.Size = size
+		buffers[level] = buffer
+	}
+	for name, policy := range policies {
+		level, ok := levels[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown qos level %s", OutboundDropPolicyKeyName, name)
+		}
+		switch DropPolicy(policy) {
+		case DropOldest, DropNewest:
+		default:
+			return nil, fmt.Errorf("%s: policy for %s must be %s or %s", OutboundDropPolicyKeyName, name, DropOldest, DropNewest)
+		}
+		buffer := buffers[level]
+		buffer.Policy = DropPolicy(policy)
+		buffers[level] = buffer
+	}
+	return buffers, nil
+}
+
+// outboundBuffer holds upstream messages while talaria is unreachable. Every
+// QoS level has its own bound and drop policy, but messages come back out in
+// the order they were pushed, whatever their level.
+//
+// Messages are pushed while the oldest one is being written, so the peeked
+// message is set aside: a push never drops it, and Pop removes that message
+// and no other.
+type outboundBuffer struct {
+	lock   sync.Mutex
+	queues map[wrp.QOSLevel]*qosQueue
+	seq    uint64
+	peeked uint64
+}
+
+type qosQueue struct {
+	BufferConfig
+	entries []bufferEntry
+	dropped uint64
+}
+
+type bufferEntry struct {
+	seq uint64
+	msg *wrp.Message
+}
+
+func newOutboundBuffer(config map[wrp.QOSLevel]BufferConfig) *outboundBuffer {
+	b := &outboundBuffer{
+		queues: make(map[wrp.QOSLevel]*qosQueue, len(qosLevels)),
+	}
+	for _, level := range qosLevels {
+		b.queues[level] = &qosQueue{BufferConfig: config[level]}
+	}
+	return b
+}
+
+// Push adds the message to the buffer of its QoS level. When a message had to
+// be dropped to stay within the bound, the number of messages dropped so far
+// for that level is returned, otherwise zero.
+func (b *outboundBuffer) Push(msg *wrp.Message) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	queue := b.queues[msg.QualityOfService.Level()]
+	// the message being written does not count against the bound
+	first := 0
+	if len(queue.entries) > 0 && queue.entries[0].seq == b.peeked {
+		first = 1
+	}
+	if len(queue.entries)-first < queue.Size {
+		b.seq++
+		queue.entries = append(queue.entries, bufferEntry{seq: b.seq, msg: msg})
+		return 0
+	}
+
+	queue.dropped++
+	if queue.Policy == DropOldest && queue.Size > 0 {
+		queue.entries = append(queue.entries[:first], queue.entries[first+1:]...)
+		b.seq++
+		queue.entries = append(queue.entries, bufferEntry{seq: b.seq, msg: msg})
+	}
+	return queue.dropped
+}
+
+// Peek returns the oldest buffered message, or nil when the buffer is empty.
+// The message is kept until Pop or Release.
+func (b *outboundBuffer) Peek() *wrp.Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.peeked = 0
+	if queue := b.head(); queue != nil {
+		b.peeked = queue.entries[0].seq
+		return queue.entries[0].msg
+	}
+	return nil
+}
+
+// Pop removes the message returned by the last Peek, once it was sent.
+func (b *outboundBuffer) Pop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.peeked == 0 {
+		return
+	}
+	// the peeked message is never dropped, so it is still at the front of
+	// its queue
+	if queue := b.head(); queue != nil && queue.entries[0].seq == b.peeked {
+		queue.entries[0] = bufferEntry{}
+		queue.entries = queue.entries[1:]
+	}
+	b.peeked = 0
+}
+
+// Release gives the message returned by the last Peek back to the buffer,
+// when it could not be sent.
+func (b *outboundBuffer) Release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.peeked = 0
+}
+
+func (b *outboundBuffer) head() *qosQueue {
+	var oldest *qosQueue
+	for _, queue := range b.queues {
+		if len(queue.entries) == 0 {
+			continue
+		}
+		if oldest == nil || queue.entries[0].seq < oldest.entries[0].seq {
+			oldest = queue
+		}
+	}
+	return oldest
+}
+
+// Len returns the number of buffered messages.
+func (b *outboundBuffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for _, queue := range b.queues {
+		n += len(queue.entries)
+	}
+	return n
+}
+
+// Dropped returns the number of messages dropped so far for each QoS level.
+func (b *outboundBuffer) Dropped() map[string]uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	dropped := make(map[string]uint64, len(b.queues))
+	for level, queue := range b.queues {
+		dropped[strings.ToLower(level.String())] = queue.dropped
+	}
+	return dropped
+}
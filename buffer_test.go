@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func bufferEvent(name string, qos wrp.QOSValue) *wrp.Message {
+	return &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:" + name, QualityOfService: qos}
+}
+
+func newTestBuffer(size int, policy DropPolicy) *outboundBuffer {
+	config := make(map[wrp.QOSLevel]BufferConfig, len(qosLevels))
+	for _, level := range qosLevels {
+		config[level] = BufferConfig{Size: size, Policy: policy}
+	}
+	return newOutboundBuffer(config)
+}
+
+// drainBuffer pops every buffered message and returns their destinations.
+func drainBuffer(b *outboundBuffer) []string {
+	var got []string
+	for msg := b.Peek(); msg != nil; msg = b.Peek() {
+		got = append(got, msg.Destination)
+		b.Pop()
+	}
+	return got
+}
+
+func TestOutboundBufferDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy  DropPolicy
+		want    []string
+		dropped uint64
+	}{
+		{DropOldest, []string{"event:b", "event:high", "event:c"}, 1},
+		{DropNewest, []string{"event:a", "event:b", "event:high"}, 1},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			b := newTestBuffer(2, test.policy)
+			b.Push(bufferEvent("a", 0))
+			b.Push(bufferEvent("b", 0))
+			b.Push(bufferEvent("high", 50))
+			if dropped := b.Push(bufferEvent("c", 0)); dropped != test.dropped {
+				t.Fatalf("expected %d dropped, got %d", test.dropped, dropped)
+			}
+
+			got := drainBuffer(b)
+			if len(got) != len(test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("expected %v, got %v", test.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboundBufferKeepsPeekedMessage(t *testing.T) {
+	b := newTestBuffer(1, DropOldest)
+	b.Push(bufferEvent("a", 0))
+	if msg := b.Peek(); msg == nil || msg.Destination != "event:a" {
+		t.Fatalf("expected to peek event:a, got %v", msg)
+	}
+
+	// a is being written, so it neither counts against the bound nor is it
+	// the one dropped
+	b.Push(bufferEvent("b", 0))
+	b.Pop()
+	if b.Len() != 1 || b.Dropped()["low"] != 0 {
+		t.Fatalf("expected b to stay buffered, got %d buffered and %d dropped", b.Len(), b.Dropped()["low"])
+	}
+
+	b.Peek()
+	b.Push(bufferEvent("c", 0))
+	b.Push(bufferEvent("d", 0))
+	b.Pop()
+	if got := drainBuffer(b); len(got) != 1 || got[0] != "event:d" {
+		t.Fatalf("expected c to be dropped in favour of d, got %v", got)
+	}
+	if b.Dropped()["low"] != 1 {
+		t.Fatalf("expected 1 dropped, got %d", b.Dropped()["low"])
+	}
+}
+
+func TestOutboundBufferRelease(t *testing.T) {
+	b := newTestBuffer(1, DropOldest)
+	b.Push(bufferEvent("a", 0))
+	b.Peek()
+	b.Release()
+
+	// once released, a is the oldest message again and can be dropped, and
+	// there is nothing left for Pop to remove
+	b.Push(bufferEvent("b", 0))
+	b.Pop()
+	if got := drainBuffer(b); len(got) != 1 || got[0] != "event:b" {
+		t.Fatalf("expected only b to be buffered, got %v", got)
+	}
+	if b.Dropped()["low"] != 1 {
+		t.Fatalf("expected 1 dropped, got %d", b.Dropped()["low"])
+	}
+}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certificateReloader provides the client certificate presented to talaria.
+// The certificate and key files are checked on every handshake and reloaded
+// when either has changed, so rotating them does not require a restart.
+type certificateReloader struct {
+	certPath string
+	keyPath  string
+	logger   *zap.Logger
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertificateReloader(certPath string, keyPath string, logger *zap.Logger) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		logger:   logger,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetClientCertificate satisfies tls.Config.GetClientCertificate. If the files
+// changed but can no longer be loaded, the previous certificate is kept.
+func (r *certificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			r.logger.Error("failed to reload client certificate, keeping the previous one", zap.Error(err))
+		} else {
+			r.logger.Info("reloaded client certificate", zap.String("cert", r.certPath))
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certificateReloader) changed() bool {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certTime) || !keyInfo.ModTime().Equal(r.keyTime)
+}
+
+func (r *certificateReloader) reload() error {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ClientCertPathKeyName, err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ClientKeyPathKeyName, err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate %s and key %s: %w", r.certPath, r.keyPath, err)
+	}
+
+	r.cert = &cert
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -24,6 +25,12 @@ import (
 	_ "nanomsg.org/go/mangos/v2/transport/all"
 )
 
+const (
+	// How long the deregistration is given to reach parodus before the push
+	// socket is closed, which drops anything still queued.
+	deregistrationLinger = 100 * time.Millisecond
+)
+
 type SendMessageHandler interface {
 	SendMessage(msg wrp.Message, c context.Context) error
 }
@@ -48,6 +55,10 @@ type client struct {
 
 	msgHandler      kratos.DownstreamHandler
 	parodusUpstream chan wrp.Message
+
+	// pending holds the requests to parodus waiting for a response
+	lock    sync.Mutex
+	pending map[string]chan wrp.Message
 }
 
 type ClientConfig struct {
@@ -104,6 +115,7 @@ func StartClient(config ClientConfig, lc fx.Lifecycle) (SendMessageHandler, erro
 		stopHandling:    make(chan struct{}),
 		msgHandler:      config.MSGHandler,
 		parodusUpstream: make(chan wrp.Message, 100),
+		pending:         make(map[string]chan wrp.Message),
 	}
 	// create push socket
 	if parodusSock, err := push.NewSocket(); err != nil {
@@ -128,14 +140,20 @@ func StartClient(config ClientConfig, lc fx.Lifecycle) (SendMessageHandler, erro
 	wrpBusRead := make(chan wrp.Message, 100)
 	ticker := time.NewTicker(config.Register)
 	stopTicker := make(chan struct{}, 1)
+	tickerStopped := make(chan struct{})
+	writerStopped := make(chan struct{})
 	lc.Append(fx.Hook{
 		OnStart: func(context context.Context) error {
 			go ReadPump(client.serviceSock, dataBus, client.logger)
-			go WritePump(client.parodusSock, client.parodusUpstream, client.stopSending, client.logger)
+			go func() {
+				writeBus(client.parodusSock, client.parodusUpstream, client.stopSending, client.logger)
+				close(writerStopped)
+			}()
 			go ParseBus(wrpBusRead, dataBus, client.stopParsing, client.logger)
 			go client.handleMSG(wrpBusRead, client.parodusUpstream)
 			client.sendRegistration()
 			go func() { // Send alive every tick
+				defer close(tickerStopped)
 				for {
 					select {
 					case <-stopTicker:
@@ -150,10 +168,24 @@ func StartClient(config ClientConfig, lc fx.Lifecycle) (SendMessageHandler, erro
 		},
 		OnStop: func(context context.Context) error {
 			logging.Info(client.logger).Log(logging.MessageKey(), "stopping client")
-			close(client.stopSending)
+			// nothing may register the service again once it deregistered, and
+			// the deregistration goes after the writes already queued
+			close(stopTicker)
 			close(client.stopHandling)
+			close(client.stopSending)
+			for _, stopped := range []chan struct{}{tickerStopped, writerStopped} {
+				select {
+				case <-stopped:
+				case <-context.Done():
+				}
+			}
+			client.sendDeregistration()
+			select {
+			case <-time.After(deregistrationLinger):
+			case <-context.Done():
+			}
+			client.parodusSock.Close()
 			close(client.stopParsing)
-			close(stopTicker)
 			return nil
 		},
 	})
@@ -169,6 +201,9 @@ func (c *client) handleMSG(wrpBusIn chan wrp.Message, wrpBusOut chan wrp.Message
 			return
 		case msg := <-wrpBusIn:
 			logging.Debug(c.logger).Log(logging.MessageKey(), "received msg", "UUID", msg.TransactionUUID)
+			if c.deliverResponse(msg) {
+				continue
+			}
 
 			switch msg.Type {
 			case wrp.ServiceAliveMessageType:
@@ -184,7 +219,10 @@ func (c *client) handleMSG(wrpBusIn chan wrp.Message, wrpBusOut chan wrp.Message
 					ServiceName:     msg.ServiceName,
 				}
 			default:
-				wrpBusOut <- *c.msgHandler.HandleMessage(&msg)
+				// events, like the cloud status, do not need a response
+				if response := c.msgHandler.HandleMessage(&msg); response != nil {
+					wrpBusOut <- *response
+				}
 			}
 
 		}
@@ -199,6 +237,21 @@ func (client *client) sendRegistration() {
 	}
 	client.parodusUpstream <- msg
 }
+
+// sendDeregistration tells parodus the service is going away, so cloud requests
+// are no longer routed to it. A registration without a url is a
+// deregistration. It is written straight to the socket, once the messages
+// that were queued have been written.
+func (client *client) sendDeregistration() {
+	msg := wrp.Message{
+		Type:        wrp.ServiceRegistrationMessageType,
+		ServiceName: client.name,
+	}
+	if err := SendMessage(client.parodusSock, msg); err != nil {
+		logging.Error(client.logger).Log(logging.MessageKey(), "failed to deregister", logging.ErrorKey(), err)
+	}
+}
+
 func (client *client) SendMessage(msg wrp.Message, c context.Context) error {
 	select {
 	case <-c.Done():
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// CloudStatusEventPrefix starts the destination of the events parodus
+	// sends every registered service when its connection to the cloud
+	// changes. The destination ends with the new state: connecting, online
+	// or offline.
+	CloudStatusEventPrefix = "event:cloud-status/"
+
+	// CloudStatusDestination is the destination of a request parodus answers
+	// itself, with a CloudStatus, instead of sending it to the cloud.
+	CloudStatusDestination = "parodus/cloud-status"
+)
+
+var (
+	errNoCloudStatus = errors.New("handler cannot query the cloud status")
+)
+
+// CloudStatus is the state of the connection between parodus and the cloud.
+// The url, connection time and ping round trip time are only set while
+// parodus is online.
+type CloudStatus struct {
+	State           string        `json:"state"`
+	URL             string        `json:"url,omitempty"`
+	ConnectedFor    time.Duration `json:"connected_for,omitempty"`
+	LastCloseReason string        `json:"last_close_reason,omitempty"`
+	PingRTT         time.Duration `json:"ping_rtt,omitempty"`
+}
+
+// CloudStatusQuerier asks parodus about its connection to the cloud. The
+// SendMessageHandler returned by StartClient implements it.
+type CloudStatusQuerier interface {
+	CloudStatus(c context.Context) (CloudStatus, error)
+}
+
+// GetCloudStatus asks parodus about its connection to the cloud through the
+// handler returned by StartClient.
+func GetCloudStatus(c context.Context, handler SendMessageHandler) (CloudStatus, error) {
+	querier, ok := handler.(CloudStatusQuerier)
+	if !ok {
+		return CloudStatus{}, errNoCloudStatus
+	}
+	return querier.CloudStatus(c)
+}
+
+func (client *client) CloudStatus(c context.Context) (CloudStatus, error) {
+	msg := wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          client.name,
+		Destination:     CloudStatusDestination,
+		TransactionUUID: uuid.NewString(),
+		ServiceName:     client.name,
+	}
+	response, err := client.request(c, msg)
+	if err != nil {
+		return CloudStatus{}, err
+	}
+	if response.Status != nil && *response.Status != http.StatusOK {
+		return CloudStatus{}, fmt.Errorf("cloud status query failed with status %d", *response.Status)
+	}
+	var status CloudStatus
+	err = json.Unmarshal(response.Payload, &status)
+	return status, err
+}
+
+// request sends the message to parodus and waits for the response with the
+// same transaction uuid, which is kept from the MSGHandler.
+func (client *client) request(c context.Context, msg wrp.Message) (wrp.Message, error) {
+	responses := make(chan wrp.Message, 1)
+	client.lock.Lock()
+	client.pending[msg.TransactionUUID] = responses
+	client.lock.Unlock()
+	defer func() {
+		client.lock.Lock()
+		delete(client.pending, msg.TransactionUUID)
+		client.lock.Unlock()
+	}()
+
+	if err := client.SendMessage(msg, c); err != nil {
+		return wrp.Message{}, err
+	}
+	select {
+	case <-c.Done():
+		return wrp.Message{}, c.Err()
+	case response := <-responses:
+		return response, nil
+	}
+}
+
+// deliverResponse hands a response to the request waiting for it, reporting
+// whether there was one.
+func (client *client) deliverResponse(msg wrp.Message) bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	responses, ok := client.pending[msg.TransactionUUID]
+	if !ok || msg.TransactionUUID == "" {
+		return false
+	}
+	select {
+	case responses <- msg:
+	default:
+	}
+	return true
+}
@@ -28,24 +28,41 @@ func ReadPump(pullSock mangos.Socket, msgBus chan []byte, logger log.Logger) {
 }
 
 func WritePump(pushSock mangos.Socket, bus chan wrp.Message, stopWriting chan struct{}, logger log.Logger) {
+	writeBus(pushSock, bus, stopWriting, logger)
+	// TODO: should I do more logic for error handling
+	pushSock.Close()
+}
+
+// writeBus sends the messages on the bus until it is stopped, then sends the
+// ones already queued and returns, leaving the socket open.
+func writeBus(pushSock mangos.Socket, bus chan wrp.Message, stopWriting chan struct{}, logger log.Logger) {
 	for {
 		select {
 		case <-stopWriting:
 			logging.Debug(logger).Log(logging.MessageKey(), "writing pump stopping")
-			// TODO: should I do more logic for error handling
-			pushSock.Close()
-			return
-		case msg := <-bus:
-			logging.Debug(logger).Log(logging.MessageKey(), "sending message", "wrp", msg.MessageType().String())
-			data := wrp.MustEncode(&msg, wrp.Msgpack)
-			err := pushSock.Send(data)
-			if err != nil {
-				logging.Error(logger).Log(logging.MessageKey(), "Failed to Send Message on socket", logging.ErrorKey(), err)
+			for {
+				select {
+				case msg := <-bus:
+					writeMessage(pushSock, msg, logger)
+				default:
+					return
+				}
 			}
+		case msg := <-bus:
+			writeMessage(pushSock, msg, logger)
 		}
 	}
 }
 
+func writeMessage(pushSock mangos.Socket, msg wrp.Message, logger log.Logger) {
+	logging.Debug(logger).Log(logging.MessageKey(), "sending message", "wrp", msg.MessageType().String())
+	data := wrp.MustEncode(&msg, wrp.Msgpack)
+	err := pushSock.Send(data)
+	if err != nil {
+		logging.Error(logger).Log(logging.MessageKey(), "Failed to Send Message on socket", logging.ErrorKey(), err)
+	}
+}
+
 func ParseBus(wrpBusOut chan wrp.Message, dataBusIn chan []byte, stopReading chan struct{}, logger log.Logger) {
 	logging.Debug(logger).Log(logging.MessageKey(), "Starting HandleMSGBus")
 	defer func() {
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// SubscriptionsDestination is where a service manages the events it
+	// wants copies of. A Create message adds a subscription, a Delete
+	// message removes it and a Retrieve message lists them.
+	SubscriptionsDestination = "parodus/subscriptions"
+)
+
+var (
+	errNoSubscriptions = errors.New("handler cannot subscribe to events")
+)
+
+// Subscription selects the events, by destination, a service is sent a copy
+// of when another local service sends them to the cloud. The pattern is a
+// glob matching the whole destination, where * matches any run of characters,
+// including /, and ? matches a single one. When Regex is set the pattern is a
+// regular expression, which may match any part of the destination.
+type Subscription struct {
+	Pattern string `json:"pattern"`
+	Regex   bool   `json:"regex,omitempty"`
+}
+
+// EventSubscriber manages the event subscriptions of the service. The
+// SendMessageHandler returned by StartClient implements it.
+type EventSubscriber interface {
+	Subscribe(c context.Context, subscription Subscription) error
+	Unsubscribe(c context.Context, subscription Subscription) error
+}
+
+// Subscribe asks parodus for copies of the events matching the subscription
+// through the handler returned by StartClient. The copies are handed to the
+// MSGHandler.
+func Subscribe(c context.Context, handler SendMessageHandler, subscription Subscription) error {
+	subscriber, ok := handler.(EventSubscriber)
+	if !ok {
+		return errNoSubscriptions
+	}
+	return subscriber.Subscribe(c, subscription)
+}
+
+// Unsubscribe removes a subscription made with Subscribe.
+func Unsubscribe(c context.Context, handler SendMessageHandler, subscription Subscription) error {
+	subscriber, ok := handler.(EventSubscriber)
+	if !ok {
+		return errNoSubscriptions
+	}
+	return subscriber.Unsubscribe(c, subscription)
+}
+
+func (client *client) Subscribe(c context.Context, subscription Subscription) error {
+	return client.changeSubscription(c, wrp.CreateMessageType, subscription)
+}
+
+func (client *client) Unsubscribe(c context.Context, subscription Subscription) error {
+	return client.changeSubscription(c, wrp.DeleteMessageType, subscription)
+}
+
+func (client *client) changeSubscription(c context.Context, msgType wrp.MessageType, subscription Subscription) error {
+	payload, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	msg := wrp.Message{
+		Type:            msgType,
+		Source:          client.name,
+		Destination:     SubscriptionsDestination,
+		TransactionUUID: uuid.NewString(),
+		ContentType:     "application/json",
+		Payload:         payload,
+		ServiceName:     client.name,
+	}
+	response, err := client.request(c, msg)
+	if err != nil {
+		return err
+	}
+	if response.Status != nil && *response.Status >= http.StatusBadRequest {
+		return fmt.Errorf("%s of event subscription %q failed with status %d: %s", msgType.FriendlyName(), subscription.Pattern,
+			*response.Status, response.Payload)
+	}
+	return nil
+}
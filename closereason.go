@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// The reasons reported to talaria for why the previous connection ended. The
+// names follow C parodus where it has an equivalent.
+const (
+	CloseReasonProcessStart  = "webpa_process_starts"
+	CloseReasonPingMiss      = "Ping_Miss"
+	CloseReasonSocketError   = "Socket_Error"
+	CloseReasonServerClose   = "Server_Close"
+	CloseReasonSIGTERM       = "SIGTERM"
+	CloseReasonNetworkChange = "Network_Interface_Changed"
+	CloseReasonCertError     = "SSL_Cert_Error"
+	CloseReasonFailback      = "Failback_To_Preferred_Endpoint"
+	CloseReasonUnknown       = "Unknown"
+)
+
+// closeReason keeps the reason the last upstream connection ended. It is
+// written to a file so the reason survives a restart of parodus.
+type closeReason struct {
+	path   string
+	logger *zap.Logger
+
+	lock   sync.Mutex
+	reason string
+}
+
+// loadCloseReason reads the reason left by the previous run. When there is
+// none, parodus is starting fresh.
+func loadCloseReason(path string, logger *zap.Logger) *closeReason {
+	c := &closeReason{
+		path:   path,
+		logger: logger,
+		reason: CloseReasonProcessStart,
+	}
+	if path == "" {
+		return c
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("failed to read close reason", zap.String("file", path), zap.Error(err))
+		}
+		return c
+	}
+	if reason := strings.TrimSpace(string(data)); reason != "" {
+		c.reason = reason
+	}
+	logger.Info("loaded last close reason", zap.String("reason", c.reason))
+	return c
+}
+
+// Get returns the reason the last connection ended.
+func (c *closeReason) Get() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.reason
+}
+
+// Set records why the connection ended.
+func (c *closeReason) Set(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reason = reason
+	c.persist(reason)
+}
+
+// Connected is called once talaria accepts a connection. Until it ends, the
+// persisted reason is Unknown, so a crash is not mistaken for the last close.
+func (c *closeReason) Connected() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.persist(CloseReasonUnknown)
+}
+
+func (c *closeReason) persist(reason string) {
+	if c.path == "" {
+		return
+	}
+	if err := writeFileAtomic(c.path, []byte(reason+"\n")); err != nil {
+		c.logger.Error("failed to save close reason", zap.String("file", c.path), zap.Error(err))
+	}
+}
+
+// isCertError reports whether the dial failed verifying talaria's certificate.
+func isCertError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
@@ -5,10 +5,12 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/xmidt-org/wrp-go/v3"
 	"go.uber.org/fx"
 )
 
@@ -25,15 +27,40 @@ const (
 	FirmwareNameKeyName             = "fw-name"
 	BootTimeKeyName                 = "boot-time"
 
-	PingTimeoutKeyName = "xmidt-ping-timeout"
-	URLKeyName         = "xmidt-url"
-	MaxBackoffKeyName  = "xmidt-backoff-max"
-	InterfaceKeyName   = "xmidt-interface-used"
-	LocalURLKeyName    = "parodus-local-url"
-	PartnerIDKeyName   = "partner-id"
-	CertPathKeyName    = "ssl-cert-path"
-	IPv4KeyName        = "force-ipv4"
-	IPv6KeyName        = "force-ipv6"
+	PingTimeoutKeyName          = "xmidt-ping-timeout"
+	URLKeyName                  = "xmidt-url"
+	MaxBackoffKeyName           = "xmidt-backoff-max"
+	InterfaceKeyName            = "xmidt-interface-used"
+	LocalURLKeyName             = "parodus-local-url"
+	PartnerIDKeyName            = "partner-id"
+	CertPathKeyName             = "ssl-cert-path"
+	ClientCertPathKeyName       = "client-cert-path"
+	ClientKeyPathKeyName        = "client-key-path"
+	IPv4KeyName                 = "force-ipv4"
+	IPv6KeyName                 = "force-ipv6"
+	TokenScriptKeyName          = "token-acquisition-script"
+	DNSTXTURLKeyName            = "dns-txt-url"
+	JWTAlgorithmKeyName         = "jwt-algo"
+	JWTPublicKeyFileKeyName     = "jwt-public-key-file"
+	OutboundBufferSizeKeyName   = "outbound-buffer-size"
+	OutboundDropPolicyKeyName   = "outbound-drop-policy"
+	SpoolDirKeyName             = "spool-dir"
+	SpoolMaxSizeKeyName         = "spool-max-size"
+	SpoolFsyncKeyName           = "spool-fsync"
+	SpoolEventsKeyName          = "spool-events"
+	CloseReasonFileKeyName      = "close-reason-file"
+	FailbackIntervalKeyName     = "xmidt-failback-interval"
+	ProxyKeyName                = "proxy"
+	ProxyCredentialsFileKeyName = "proxy-credentials-file"
+	ServiceKeepAliveKeyName     = "service-keepalive-interval"
+	ServiceKeepAliveMissKeyName = "service-keepalive-misses"
+	CRUDFileKeyName             = "crud-config-file"
+	AuthorizationPolicyKeyName  = "authorization-policy"
+	ServiceTimeoutKeyName       = "service-request-timeout"
+	ServiceTimeoutsKeyName      = "service-request-timeouts"
+	ServiceQueueSizeKeyName     = "service-queue-size"
+	ServiceQueuePolicyKeyName   = "service-queue-policy"
+	ServiceWorkersKeyName       = "service-workers"
 
 	DebugKeyName   = "debug"
 	VersionKeyName = "version"
@@ -52,15 +79,40 @@ func SetupFlagSet(fs *pflag.FlagSet) error {
 	fs.StringP(HardwareLastRebootReasonKeyName, "r", "", "the last known reboot reason")
 	fs.StringP(FirmwareNameKeyName, "n", "", "firmware name and version currently running")
 	fs.Int64P(BootTimeKeyName, "b", time.Now().Unix(), "the boot time in unix time")
-	fs.StringP(URLKeyName, "u", "", "the hardware model name")
+	fs.StringSliceP(URLKeyName, "u", nil, "prioritized list of xmidt urls, parodus fails over to the next when one is unreachable")
+	fs.Int(FailbackIntervalKeyName, 300, "how often in seconds the preferred xmidt url is probed while connected to another one, 0 disables failing back")
 	fs.IntP(MaxBackoffKeyName, "o", 60, "the maximum value in seconds for the backoff algorithm")
 	fs.IntP(PingTimeoutKeyName, "t", 60, "the maximum time to wait between pings before assuming the upstream is broken")
-	fs.StringP(InterfaceKeyName, "i", "eth0", "the device interface being used to connect to the cloud")
+	fs.StringP(InterfaceKeyName, "i", "eth0", "the device interface being used to connect to the cloud, when set the upstream connection is bound to its address")
 	fs.StringP(LocalURLKeyName, "l", "tcp://127.0.0.1:6666", "Parodus local server url")
 	fs.StringP(PartnerIDKeyName, "p", "", "partner ID of iot/gateway device")
-	fs.StringP(CertPathKeyName, "c", "", "provide the certs for establishing secure upstream")
+	fs.StringArray(AuthorizationPolicyKeyName, []string{PartnerIDPolicy}, "policy cloud requests must pass before reaching a local service: partner-id, partner-id:allow-empty, source:<regexp> or destination:<regexp>, repeat for more")
+	fs.StringP(CertPathKeyName, "c", "", "PEM bundle of CA certificates trusted when establishing a secure upstream")
+	fs.String(ClientCertPathKeyName, "", "PEM client certificate presented to talaria for mutual TLS, reloaded when it changes")
+	fs.String(ClientKeyPathKeyName, "", "PEM private key for the client certificate, reloaded when it changes")
 	fs.BoolP(IPv4KeyName, "4", false, "forcefully connect parodus to ipv4 address")
 	fs.BoolP(IPv6KeyName, "6", false, "forcefully connect parodus to ipv6 address")
+	fs.StringP(TokenScriptKeyName, "J", "", "script called with the serial number and MAC that prints the auth token sent to talaria")
+	fs.StringP(DNSTXTURLKeyName, "D", "", "domain of the dns txt record holding a signed jwt with the talaria endpoint, queried as <mac>.<domain>")
+	fs.StringP(JWTAlgorithmKeyName, "a", "", "algorithm the dns txt record jwt must be signed with, e.g. RS256")
+	fs.StringP(JWTPublicKeyFileKeyName, "k", "", "PEM public key used to verify the dns txt record jwt")
+	fs.StringToInt(OutboundBufferSizeKeyName, defaultBufferSizes, "messages buffered per qos level while talaria is unreachable")
+	fs.StringToString(OutboundDropPolicyKeyName, defaultDropPolicies, "message dropped per qos level when its buffer is full, oldest or newest")
+	fs.String(SpoolDirKeyName, "", "directory of the on-disk spool for upstream events that must survive a restart, disabled when empty")
+	fs.Int64(SpoolMaxSizeKeyName, 10<<20, "the maximum size in bytes of the spool before the oldest events are dropped")
+	fs.String(SpoolFsyncKeyName, string(FsyncAlways), "when spooled events are synced to disk: always, interval or never")
+	fs.String(SpoolEventsKeyName, ".*", "regular expression for the event destinations that are spooled")
+	fs.String(ProxyKeyName, "", "http or socks5 proxy url the upstream connection tunnels through, the proxy environment variables are used when empty")
+	fs.String(ProxyCredentialsFileKeyName, "", "file holding the user:password for a proxy url without credentials")
+	fs.Int(ServiceKeepAliveKeyName, 5, "how often in seconds local services are sent a keep alive")
+	fs.Int(ServiceKeepAliveMissKeyName, 3, "the number of keep alives a local service can miss before it is evicted")
+	fs.Int(ServiceTimeoutKeyName, 30, "how long in seconds a local service has to answer a request before parodus answers it with a 504, 0 waits forever")
+	fs.StringToInt(ServiceTimeoutsKeyName, nil, "per service overrides of the request timeout, as name=seconds")
+	fs.Int(ServiceQueueSizeKeyName, 100, "messages waiting to be sent to each local service")
+	fs.String(ServiceQueuePolicyKeyName, string(QueueDropOldest), "what happens to a message for a service whose queue is full: block, drop-oldest or reject")
+	fs.Int(ServiceWorkersKeyName, 4, "how many local services have their messages handled at once, the messages of one service are handled in order")
+	fs.StringP(CRUDFileKeyName, "C", "", "JSON file keeping the device tags managed through parodus/tags, kept in memory only when empty")
+	fs.String(CloseReasonFileKeyName, "/tmp/parodus-close-reason", "file keeping why the last upstream connection ended across restarts, disabled when empty")
 
 	fs.BoolP(DebugKeyName, "", false, "enables debug logging")
 	fs.BoolP(VersionKeyName, "v", false, "print version and exit")
@@ -68,26 +120,46 @@ func SetupFlagSet(fs *pflag.FlagSet) error {
 }
 
 type Config struct {
-	HardwareModel            string
-	HardwareSerialNumber     string
-	HardwareManufacturer     string
-	HardwareMAC              string
-	HardwareLastRebootReason string
-	FirmwareName             string
-	BootTime                 int64
-	PingTimeout              int
-	URL                      string
-	MaxBackoff               int
-	Interface                string
-	Protocol                 string
-	UUID                     string
-	LocalURL                 string
-	PartnerID                string
-	CertPath                 string
-	AuthToken                string
-	DeviceID                 string
-	IPv4                     bool
-	IPv6                     bool
+	HardwareModel              string
+	HardwareSerialNumber       string
+	HardwareManufacturer       string
+	HardwareMAC                string
+	HardwareLastRebootReason   string
+	FirmwareName               string
+	BootTime                   int64
+	PingTimeout                int
+	URLs                       []string
+	FailbackInterval           int
+	MaxBackoff                 int
+	Interface                  string
+	BindInterface              bool
+	Protocol                   string
+	UUID                       string
+	LocalURL                   string
+	PartnerID                  string
+	AuthorizationPolicies      []string
+	CertPath                   string
+	ClientCertPath             string
+	ClientKeyPath              string
+	TokenScript                string
+	DNSTXTURL                  string
+	JWTAlgorithm               string
+	JWTPublicKeyFile           string
+	OutboundBuffer             map[wrp.QOSLevel]BufferConfig
+	Spool                      SpoolConfig
+	CloseReasonFile            string
+	Proxy                      string
+	ProxyCredentialsFile       string
+	ServiceKeepAlive           int
+	ServiceMaxMissedKeepAlives int
+	ServiceRequestTimeout      int
+	ServiceRequestTimeouts     map[string]int
+	ServiceQueue               QueueConfig
+	ServiceWorkers             int
+	CRUDFile                   string
+	DeviceID                   string
+	IPv4                       bool
+	IPv6                       bool
 
 	Debug        bool
 	PrintVersion bool
@@ -112,16 +184,50 @@ func Provide(in ConfigFlagIn) (Config, error) {
 	config.HardwareLastRebootReason, _ = in.FlagSet.GetString(HardwareLastRebootReasonKeyName)
 	config.FirmwareName, _ = in.FlagSet.GetString(FirmwareNameKeyName)
 	config.BootTime, _ = in.FlagSet.GetInt64(BootTimeKeyName)
-	config.URL, _ = in.FlagSet.GetString(URLKeyName)
-	config.URL += XMIDTPathURL
+	urls, _ := in.FlagSet.GetStringSlice(URLKeyName)
+	for _, u := range urls {
+		if u = strings.TrimSpace(u); u != "" {
+			config.URLs = append(config.URLs, strings.TrimSuffix(u, "/")+XMIDTPathURL)
+		}
+	}
+	config.FailbackInterval, _ = in.FlagSet.GetInt(FailbackIntervalKeyName)
 	config.MaxBackoff, _ = in.FlagSet.GetInt(MaxBackoffKeyName)
 	config.PingTimeout, _ = in.FlagSet.GetInt(PingTimeoutKeyName)
 	config.Interface, _ = in.FlagSet.GetString(InterfaceKeyName)
+	// the default interface is only reported to the cloud, the connection
+	// is bound to an interface named explicitly
+	config.BindInterface = in.FlagSet.Changed(InterfaceKeyName)
 	config.LocalURL, _ = in.FlagSet.GetString(LocalURLKeyName)
 	config.PartnerID, _ = in.FlagSet.GetString(PartnerIDKeyName)
+	config.AuthorizationPolicies, _ = in.FlagSet.GetStringArray(AuthorizationPolicyKeyName)
 	config.CertPath, _ = in.FlagSet.GetString(CertPathKeyName)
+	config.ClientCertPath, _ = in.FlagSet.GetString(ClientCertPathKeyName)
+	config.ClientKeyPath, _ = in.FlagSet.GetString(ClientKeyPathKeyName)
 	config.IPv4, _ = in.FlagSet.GetBool(IPv4KeyName)
 	config.IPv6, _ = in.FlagSet.GetBool(IPv6KeyName)
+	config.TokenScript, _ = in.FlagSet.GetString(TokenScriptKeyName)
+	config.DNSTXTURL, _ = in.FlagSet.GetString(DNSTXTURLKeyName)
+	config.JWTAlgorithm, _ = in.FlagSet.GetString(JWTAlgorithmKeyName)
+	config.JWTPublicKeyFile, _ = in.FlagSet.GetString(JWTPublicKeyFileKeyName)
+	bufferSizes, _ := in.FlagSet.GetStringToInt(OutboundBufferSizeKeyName)
+	dropPolicies, _ := in.FlagSet.GetStringToString(OutboundDropPolicyKeyName)
+	config.Spool.Dir, _ = in.FlagSet.GetString(SpoolDirKeyName)
+	config.Spool.MaxSize, _ = in.FlagSet.GetInt64(SpoolMaxSizeKeyName)
+	spoolFsync, _ := in.FlagSet.GetString(SpoolFsyncKeyName)
+	config.Spool.Fsync = FsyncPolicy(spoolFsync)
+	spoolEvents, _ := in.FlagSet.GetString(SpoolEventsKeyName)
+	config.CloseReasonFile, _ = in.FlagSet.GetString(CloseReasonFileKeyName)
+	config.Proxy, _ = in.FlagSet.GetString(ProxyKeyName)
+	config.ProxyCredentialsFile, _ = in.FlagSet.GetString(ProxyCredentialsFileKeyName)
+	config.ServiceKeepAlive, _ = in.FlagSet.GetInt(ServiceKeepAliveKeyName)
+	config.ServiceMaxMissedKeepAlives, _ = in.FlagSet.GetInt(ServiceKeepAliveMissKeyName)
+	config.ServiceRequestTimeout, _ = in.FlagSet.GetInt(ServiceTimeoutKeyName)
+	config.ServiceRequestTimeouts, _ = in.FlagSet.GetStringToInt(ServiceTimeoutsKeyName)
+	config.ServiceQueue.Size, _ = in.FlagSet.GetInt(ServiceQueueSizeKeyName)
+	queuePolicy, _ := in.FlagSet.GetString(ServiceQueuePolicyKeyName)
+	config.ServiceQueue.Policy = QueuePolicy(queuePolicy)
+	config.ServiceWorkers, _ = in.FlagSet.GetInt(ServiceWorkersKeyName)
+	config.CRUDFile, _ = in.FlagSet.GetString(CRUDFileKeyName)
 	config.DeviceID = fmt.Sprintf(DEVICEID, strings.Replace(config.HardwareMAC, ":", "", -1))
 
 	config.Debug, _ = in.FlagSet.GetBool(DebugKeyName)
@@ -130,6 +236,14 @@ func Provide(in ConfigFlagIn) (Config, error) {
 		in.PrintVersionFunc()
 	}
 
+	var err error
+	if config.OutboundBuffer, err = parseBufferConfig(bufferSizes, dropPolicies); err != nil {
+		return config, err
+	}
+	if config.Spool.Events, err = regexp.Compile(spoolEvents); err != nil {
+		return config, fmt.Errorf("%s: %w", SpoolEventsKeyName, err)
+	}
+
 	return config, validateConfig(config)
 }
 
@@ -146,8 +260,44 @@ func validateConfig(config Config) error {
 	if !validateMAC(config.HardwareMAC) {
 		return fmt.Errorf("bad mac address: %s", config.HardwareMAC)
 	}
-	if config.URL == "" {
+	if len(config.URLs) == 0 {
 		return fmt.Errorf("%s must be set", URLKeyName)
 	}
+	if config.IPv4 && config.IPv6 {
+		return fmt.Errorf("%s and %s cannot both be set", IPv4KeyName, IPv6KeyName)
+	}
+	switch config.Spool.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return fmt.Errorf("%s must be %s, %s or %s", SpoolFsyncKeyName, FsyncAlways, FsyncInterval, FsyncNever)
+	}
+	if config.DNSTXTURL != "" && (config.JWTAlgorithm == "" || config.JWTPublicKeyFile == "") {
+		return fmt.Errorf("%s and %s must be set to use %s", JWTAlgorithmKeyName, JWTPublicKeyFileKeyName, DNSTXTURLKeyName)
+	}
+	if config.ServiceKeepAlive <= 0 || config.ServiceMaxMissedKeepAlives <= 0 {
+		return fmt.Errorf("%s and %s must be positive", ServiceKeepAliveKeyName, ServiceKeepAliveMissKeyName)
+	}
+	if config.ServiceRequestTimeout < 0 {
+		return fmt.Errorf("%s cannot be negative", ServiceTimeoutKeyName)
+	}
+	for name, timeout := range config.ServiceRequestTimeouts {
+		if timeout < 0 {
+			return fmt.Errorf("%s for %s cannot be negative", ServiceTimeoutsKeyName, name)
+		}
+	}
+	if config.ServiceWorkers <= 0 {
+		return fmt.Errorf("%s must be positive", ServiceWorkersKeyName)
+	}
+	if config.ServiceQueue.Size <= 0 {
+		return fmt.Errorf("%s must be positive", ServiceQueueSizeKeyName)
+	}
+	switch config.ServiceQueue.Policy {
+	case QueueBlock, QueueDropOldest, QueueReject:
+	default:
+		return fmt.Errorf("%s must be %s, %s or %s", ServiceQueuePolicyKeyName, QueueBlock, QueueDropOldest, QueueReject)
+	}
+	if (config.ClientCertPath == "") != (config.ClientKeyPath == "") {
+		return fmt.Errorf("%s and %s must be set together", ClientCertPathKeyName, ClientKeyPathKeyName)
+	}
 	return nil
 }
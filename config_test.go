@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+func provideTestConfig(t *testing.T, args ...string) Config {
+	fs := pflag.NewFlagSet("parodus", pflag.ContinueOnError)
+	if err := SetupFlagSet(fs); err != nil {
+		t.Fatal(err)
+	}
+	args = append([]string{
+		"--hw-model=model", "--hw-serial-number=serial", "--hw-manufacturer=manufacturer",
+		"--hw-mac=112233445566", "--xmidt-url=https://talaria.example.com",
+	}, args...)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	config, err := Provide(ConfigFlagIn{FlagSet: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestInterfaceIsOnlyBoundWhenSet(t *testing.T) {
+	config := provideTestConfig(t)
+	if config.Interface != "eth0" || config.BindInterface {
+		t.Fatalf("expected the default eth0 to be reported only, got %s bound %v", config.Interface, config.BindInterface)
+	}
+	config = provideTestConfig(t, "-i", "erouter0")
+	if config.Interface != "erouter0" || !config.BindInterface {
+		t.Fatalf("expected erouter0 to be bound, got %s bound %v", config.Interface, config.BindInterface)
+	}
+
+	dialer, err := newDialer(provideTestConfig(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.NetDialContext != nil {
+		t.Fatal("expected the default interface not to bind the connection")
+	}
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	libparodus "github.com/xmidt-org/go-parodus/client"
+)
+
+// ConnectionState is the state of the upstream connection to talaria.
+type ConnectionState string
+
+const (
+	StateConnecting ConnectionState = "connecting"
+	StateOnline     ConnectionState = "online"
+	StateOffline    ConnectionState = "offline"
+)
+
+const (
+	// The number of undelivered events a subscriber can fall behind by before
+	// the oldest are dropped.
+	connectivityEventBuffer = 16
+)
+
+// ConnectionEvent describes a change of the upstream connection state. It is
+// sent as JSON to the local services.
+type ConnectionEvent struct {
+	State       ConnectionState `json:"state"`
+	Reason      string          `json:"reason,omitempty"`
+	URL         string          `json:"url,omitempty"`
+	Timestamp   time.Time       `json:"timestamp"`
+	LastOnline  *time.Time      `json:"last_online,omitempty"`
+	LastOffline *time.Time      `json:"last_offline,omitempty"`
+}
+
+// Connectivity tracks the state of the upstream connection and hands every
+// change to its subscribers.
+type Connectivity struct {
+	lock        sync.Mutex
+	current     ConnectionEvent
+	closeReason string
+	pingRTT     time.Duration
+	subscribers []chan ConnectionEvent
+}
+
+func ProvideConnectivity() *Connectivity {
+	return &Connectivity{
+		current: ConnectionEvent{
+			State:     StateOffline,
+			Reason:    CloseReasonProcessStart,
+			Timestamp: time.Now(),
+		},
+		closeReason: CloseReasonProcessStart,
+	}
+}
+
+// Current returns the latest state.
+func (c *Connectivity) Current() ConnectionEvent {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current
+}
+
+// Subscribe returns a channel receiving every state change. A subscriber that
+// falls behind loses the oldest changes, never the latest.
+func (c *Connectivity) Subscribe() <-chan ConnectionEvent {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	events := make(chan ConnectionEvent, connectivityEventBuffer)
+	c.subscribers = append(c.subscribers, events)
+	return events
+}
+
+// Set moves to a new state. Nothing is published when the state is unchanged.
+func (c *Connectivity) Set(state ConnectionState, reason string, url string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.current.State == state {
+		return
+	}
+
+	now := time.Now()
+	event := ConnectionEvent{
+		State:       state,
+		Reason:      reason,
+		URL:         url,
+		Timestamp:   now,
+		LastOnline:  c.current.LastOnline,
+		LastOffline: c.current.LastOffline,
+	}
+	switch state {
+	case StateOnline:
+		event.LastOnline = &now
+	case StateOffline:
+		event.LastOffline = &now
+	}
+	c.current = event
+	c.pingRTT = 0
+
+	for _, events := range c.subscribers {
+		select {
+		case events <- event:
+		default:
+			select {
+			case <-events:
+			default:
+			}
+			events <- event
+		}
+	}
+}
+
+// SetCloseReason records why the last connection ended.
+func (c *Connectivity) SetCloseReason(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeReason = reason
+}
+
+// SetPingRTT records the latest round trip time of a ping to talaria.
+func (c *Connectivity) SetPingRTT(rtt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pingRTT = rtt
+}
+
+// Status answers a cloud status query from a local service.
+func (c *Connectivity) Status() libparodus.CloudStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	status := libparodus.CloudStatus{
+		State:           string(c.current.State),
+		LastCloseReason: c.closeReason,
+	}
+	if c.current.State == StateOnline {
+		status.URL = c.current.URL
+		status.ConnectedFor = time.Since(c.current.Timestamp)
+		status.PingRTT = c.pingRTT
+	}
+	return status
+}
@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	ConveyHeader = "X-WebPA-Convey"
+
+	InterfaceUsedConveyKey       = "webpa-interface-used"
+	LastReconnectReasonConveyKey = "webpa-last-reconnect-reason"
+)
+
+// connectHeaders builds the headers sent to talaria on every handshake, so the
+// cloud gets the same device metadata as it does from C parodus.
+func connectHeaders(config Config, lastReconnectReason string) (http.Header, error) {
+	headers := make(http.Header)
+	headers.Set("X-Webpa-Device-Name", config.DeviceID)
+	headers.Set("X-Webpa-Firmware-Name", config.FirmwareName)
+	headers.Set("X-Webpa-Model-Name", config.HardwareModel)
+	headers.Set("X-Webpa-Manufacturer", config.HardwareManufacturer)
+
+	setHeader(headers, "X-Midt-Boot-Time", strconv.FormatInt(config.BootTime, 10))
+	setHeader(headers, "X-Midt-Last-Reboot-Reason", config.HardwareLastRebootReason)
+	setHeader(headers, "X-Midt-Interface-Used", config.Interface)
+	setHeader(headers, "X-Midt-Serial-Number", config.HardwareSerialNumber)
+	setHeader(headers, "X-Midt-Partner-Id", config.PartnerID)
+	setHeader(headers, "X-Midt-Last-Reconnect-Reason", lastReconnectReason)
+
+	convey, err := conveyHeader(config, lastReconnectReason)
+	if err != nil {
+		return nil, err
+	}
+	headers.Set(ConveyHeader, convey)
+	return headers, nil
+}
+
+// conveyHeader encodes the device metadata as base64 JSON.
+func conveyHeader(config Config, lastReconnectReason string) (string, error) {
+	convey := map[string]interface{}{
+		HardwareModelKeyName:        config.HardwareModel,
+		HardwareSerialNumberKeyName: config.HardwareSerialNumber,
+		HardwareManufacturerKeyName: config.HardwareManufacturer,
+		FirmwareNameKeyName:         config.FirmwareName,
+		BootTimeKeyName:             config.BootTime,
+	}
+	if config.HardwareLastRebootReason != "" {
+		convey[HardwareLastRebootReasonKeyName] = config.HardwareLastRebootReason
+	}
+	if config.Interface != "" {
+		convey[InterfaceUsedConveyKey] = config.Interface
+	}
+	if config.PartnerID != "" {
+		convey[PartnerIDKeyName] = config.PartnerID
+	}
+	if lastReconnectReason != "" {
+		convey[LastReconnectReasonConveyKey] = lastReconnectReason
+	}
+
+	data, err := json.Marshal(convey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func setHeader(headers http.Header, key string, value string) {
+	if value != "" {
+		headers.Set(key, value)
+	}
+}
@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// Time allowed to complete the websocket handshake with talaria.
+	handshakeTimeout = 45 * time.Second
+)
+
+// newDialer builds the websocket dialer used for every upstream connection
+// attempt.
+func newDialer(config Config, logger *zap.Logger) (*websocket.Dialer, error) {
+	proxy, err := newProxy(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            proxy,
+		HandshakeTimeout: handshakeTimeout,
+	}
+
+	if config.BindInterface || config.IPv4 || config.IPv6 {
+		netDialer := &interfaceDialer{
+			family:   "ip",
+			resolver: net.DefaultResolver,
+		}
+		if config.BindInterface {
+			netDialer.iface = config.Interface
+		}
+		if config.IPv4 {
+			netDialer.family = "ip4"
+		} else if config.IPv6 {
+			netDialer.family = "ip6"
+		}
+		dialer.NetDialContext = netDialer.DialContext
+	}
+
+	if config.CertPath == "" && config.ClientCertPath == "" {
+		return dialer, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.CertPath != "" {
+		rootCAs, err := loadCertPool(config.CertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if config.ClientCertPath != "" {
+		reloader, err := newCertificateReloader(config.ClientCertPath, config.ClientKeyPath, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+	dialer.TLSClientConfig = tlsConfig
+	return dialer, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates. Every PEM block in the
+// file must be a valid certificate and the file must hold at least one.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", CertPathKeyName, err)
+	}
+
+	pool := x509.NewCertPool()
+	count := 0
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s %s: unexpected PEM block %q", CertPathKeyName, path, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: failed to parse certificate %d: %w", CertPathKeyName, path, count+1, err)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("%s %s: no PEM certificates found", CertPathKeyName, path)
+	}
+	return pool, nil
+}
+
+// interfaceDialer opens TCP connections from an address of a single network
+// interface, optionally restricted to one IP family. The interface addresses
+// are looked up on every dial, since they may change while parodus runs.
+type interfaceDialer struct {
+	iface    string
+	family   string // "ip", "ip4" or "ip6"
+	resolver *net.Resolver
+}
+
+func (d *interfaceDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := d.resolver.LookupIP(ctx, d.family, host)
+	if err != nil {
+		return nil, err
+	}
+	locals, err := d.localIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, remote := range remotes {
+		dialer := net.Dialer{}
+		if d.iface != "" {
+			local := matchFamily(locals, remote)
+			if local == nil {
+				continue
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		conn, err := dialer.DialContext(ctx, tcpNetwork(remote), net.JoinHostPort(remote.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("%s %s has no %s address to reach %s %v", InterfaceKeyName, d.iface, d.familyName(), host, remotes)
+	}
+	return nil, lastErr
+}
+
+// localIPs lists the usable addresses of the interface. Link-local addresses
+// are skipped, as they cannot route to talaria.
+func (d *interfaceDialer) localIPs() ([]net.IP, error) {
+	if d.iface == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(d.iface)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", InterfaceKeyName, d.iface, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("%s %s is down", InterfaceKeyName, d.iface)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: failed to get addresses: %w", InterfaceKeyName, d.iface, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (d.family == "ip4" && ipNet.IP.To4() == nil) || (d.family == "ip6" && ipNet.IP.To4() != nil) {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s %s has no usable %s address", InterfaceKeyName, d.iface, d.familyName())
+	}
+	return ips, nil
+}
+
+func (d *interfaceDialer) familyName() string {
+	switch d.family {
+	case "ip4":
+		return "IPv4"
+	case "ip6":
+		return "IPv6"
+	default:
+		return "IP"
+	}
+}
+
+func matchFamily(ips []net.IP, remote net.IP) net.IP {
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (remote.To4() != nil) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func tcpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// hasLocalAddr reports whether the interface still has the address the
+// connection was made from. It is true when no interface is configured or its
+// addresses cannot be read, and false when the interface is gone.
+func hasLocalAddr(name string, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if name == "" || !ok {
+		return true
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		// the interface went away, and its addresses with it
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -20,15 +27,50 @@ import (
 	_ "nanomsg.org/go/mangos/v2/transport/all"
 )
 
+const (
+	// The number of messages a worker can fall behind by before the local
+	// services wait for it.
+	workerQueueSize = 100
+)
+
+var (
+	errServiceDeregistered = errors.New("service deregistered")
+	errServiceEvicted      = errors.New("service stopped answering keep alives")
+)
+
 type Parodus struct {
-	sock   mangos.Socket
-	logger log.Logger
+	sock     mangos.Socket
+	logger   log.Logger
+	deviceID wrp.DeviceID
 
 	client       kratos.Client
+	connectivity *Connectivity
 	stopHandling chan struct{}
+
+	// a service is evicted when it misses maxMissedKeepAlives keep alives
+	keepAlive           time.Duration
+	maxMissedKeepAlives int
+	queue               QueueConfig
+
+	// messages are handled by workers, every service always by the same one
+	// so its messages stay in order
+	workers int
+
+	// services holds the forwarder of every registered service, as the
+	// handler registry cannot be listed. The lock also guards their
+	// LastAlive.
+	lock     sync.Mutex
+	services map[string]*Forwarder
+	pending  *pendingRequests
+	upstream *upstreamRequests
+
+	tags          *tagStore
+	self          *selfHandler
+	subscriptions *eventSubscriptions
 }
 
-func StartParodus(config Config, client kratos.Client, lc fx.Lifecycle, logger log.Logger) error {
+func StartParodus(config Config, client kratos.Client, connectivity *Connectivity, upstream *upstreamRequests, self *selfHandler,
+	lc fx.Lifecycle, logger log.Logger) error {
 	var sock mangos.Socket
 	var err error
 
@@ -41,6 +83,16 @@ func StartParodus(config Config, client kratos.Client, lc fx.Lifecycle, logger l
 		return err
 	}
 	logging.Info(logger).Log(logging.MessageKey(), "Parodus Config", "config", config)
+	deviceID, err := wrp.ParseDeviceID(config.DeviceID)
+	if err != nil {
+		logging.Error(logger).Log(logging.MessageKey(), "invalid device id", logging.ErrorKey(), err, "deviceID", config.DeviceID)
+		return err
+	}
+	tags, err := loadTagStore(config.CRUDFile, logger)
+	if err != nil {
+		logging.Error(logger).Log(logging.MessageKey(), "failed to load device tags", logging.ErrorKey(), err)
+		return err
+	}
 	sock.SetPipeEventHook(func(event mangos.PipeEvent, pipe mangos.Pipe) {
 		logging.Info(logger).Log(logging.MessageKey(), "parodus pull socket event", "event", event, "pipe", pipe)
 	})
@@ -48,9 +100,26 @@ func StartParodus(config Config, client kratos.Client, lc fx.Lifecycle, logger l
 	parodus := &Parodus{
 		sock:         sock,
 		logger:       logger,
+		deviceID:     deviceID,
 		client:       client,
+		connectivity: connectivity,
+		upstream:     upstream,
 		stopHandling: make(chan struct{}),
+		services:     make(map[string]*Forwarder),
+		tags:         tags,
+
+		subscriptions: newEventSubscriptions(),
+
+		keepAlive:           time.Duration(config.ServiceKeepAlive) * time.Second,
+		maxMissedKeepAlives: config.ServiceMaxMissedKeepAlives,
+		queue:               config.ServiceQueue,
+		workers:             config.ServiceWorkers,
 	}
+	timeout, timeouts := requestTimeouts(config)
+	parodus.pending = newPendingRequests(timeout, timeouts, upstream, parodus.fail)
+	self.parodus = parodus
+	parodus.self = self
+	connectivityEvents := connectivity.Subscribe()
 
 	dataBus := make(chan []byte, 100)
 	wrpBus := make(chan wrp.Message, 100)
@@ -63,6 +132,7 @@ func StartParodus(config Config, client kratos.Client, lc fx.Lifecycle, logger l
 			go libparodus.ReadPump(parodus.sock, dataBus, logger)
 			go libparodus.ParseBus(wrpBus, dataBus, stopParsing, logger)
 			go parodus.msgHandler(wrpBus)
+			go parodus.publishConnectivity(connectivityEvents)
 			return nil
 		},
 		OnStop: func(context context.Context) error {
@@ -77,54 +147,437 @@ func StartParodus(config Config, client kratos.Client, lc fx.Lifecycle, logger l
 	return nil
 }
 
+// requestTimeouts returns how long local services have to answer a request,
+// and the overrides by service name.
+func requestTimeouts(config Config) (time.Duration, map[string]time.Duration) {
+	timeouts := make(map[string]time.Duration, len(config.ServiceRequestTimeouts))
+	for name, seconds := range config.ServiceRequestTimeouts {
+		timeouts[name] = time.Duration(seconds) * time.Second
+	}
+	return time.Duration(config.ServiceRequestTimeout) * time.Second, timeouts
+}
+
+// msgHandler hands the messages from local services to the workers and evicts
+// the services that stop answering keep alives.
 func (p *Parodus) msgHandler(wrpBus chan wrp.Message) {
-	logging.Debug(p.logger).Log(logging.MessageKey(), "Starting msgHandler")
+	logging.Debug(p.logger).Log(logging.MessageKey(), "Starting msgHandler", "workers", p.workers)
 	defer func() {
 		logging.Debug(p.logger).Log(logging.MessageKey(), "msgHandler has stopped")
 	}()
+	workers := make([]chan wrp.Message, p.workers)
+	for i := range workers {
+		workers[i] = make(chan wrp.Message, workerQueueSize)
+		go p.handleMessages(workers[i])
+	}
+	reaper := time.NewTicker(p.keepAlive)
+	defer reaper.Stop()
 	for {
 		select {
 		case <-p.stopHandling:
 			return
+		case <-reaper.C:
+			p.reap()
 		case msg := <-wrpBus:
-			switch msg.Type {
-			case wrp.ServiceRegistrationMessageType:
-				logging.Debug(p.logger).Log(logging.MessageKey(), "received service registration", "url", msg.URL, "name", msg.ServiceName)
-
-				if handler, err := p.client.HandlerRegistry().GetHandler(msg.ServiceName); err != nil {
-					// TODO: create timer for keep alive
-					service, err := CreateServiceForwarder(msg.ServiceName, msg.URL, p.logger)
-					if err != nil {
-						logging.Error(p.logger).Log(logging.MessageKey(), "failed to send message to talaria", logging.ErrorKey(), err)
-					}
-					err = p.client.HandlerRegistry().Add(service.Name, service)
-					if err != nil {
-						logging.Error(p.logger).Log(logging.MessageKey(), "failed to add service to registry", logging.ErrorKey(), err)
-					}
-				} else {
-					// update handler timestamp
-					if forwarder, ok := handler.(*Forwarder); ok {
-						forwarder.LastAlive = time.Now()
-						logging.Debug(p.logger).Log(logging.MessageKey(), "updated registration timestamp", "url", msg.URL, "name", msg.ServiceName)
-					}
-				}
-			case wrp.SimpleRequestResponseMessageType:
-				// Send message to Talaria
-				p.client.Send(&msg)
-			case wrp.SimpleEventMessageType:
-				// Send event to Talaria
-				p.client.Send(&msg)
-			case wrp.ServiceAliveMessageType:
-				// TODO: reset timer(timer should also be created
-				if handler, err := p.client.HandlerRegistry().GetHandler(msg.ServiceName); err == nil {
-					if forwarder, ok := handler.(*Forwarder); ok {
-						forwarder.LastAlive = time.Now()
-						logging.Debug(p.logger).Log(logging.MessageKey(), "updated registration timestamp", "url", msg.URL, "name", msg.ServiceName)
-					}
-				}
-			default:
-				logging.Error(p.logger).Log(logging.MessageKey(), "Unexpected WRP Message. Please file an issue at github.com/xmidt-org/go-parodus/issues", "wrp", msg)
+			select {
+			case workers[p.worker(&msg, len(workers))] <- msg:
+			case <-p.stopHandling:
+				return
 			}
 		}
 	}
 }
+
+// worker picks the worker for the service that sent the message.
+func (p *Parodus) worker(msg *wrp.Message, workers int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(originService(msg)))
+	return int(hash.Sum32() % uint32(workers))
+}
+
+func (p *Parodus) handleMessages(messages <-chan wrp.Message) {
+	for {
+		select {
+		case <-p.stopHandling:
+			return
+		case msg := <-messages:
+			p.handleMessage(&msg)
+		}
+	}
+}
+
+func (p *Parodus) handleMessage(msg *wrp.Message) {
+	switch msg.Type {
+	case wrp.ServiceRegistrationMessageType:
+		logging.Debug(p.logger).Log(logging.MessageKey(), "received service registration", "url", msg.URL, "name", msg.ServiceName)
+
+		if msg.URL == "" {
+			p.deregister(msg.ServiceName)
+			return
+		}
+		p.register(msg.ServiceName, msg.URL)
+	case wrp.SimpleRequestResponseMessageType, wrp.SimpleEventMessageType,
+		wrp.CreateMessageType, wrp.RetrieveMessageType, wrp.UpdateMessageType, wrp.DeleteMessageType:
+		p.route(msg)
+	case wrp.ServiceAliveMessageType:
+		p.lock.Lock()
+		forwarder := p.services[msg.ServiceName]
+		if forwarder != nil {
+			forwarder.LastAlive = time.Now()
+		}
+		p.lock.Unlock()
+		if forwarder != nil {
+			logging.Debug(p.logger).Log(logging.MessageKey(), "updated registration timestamp", "url", msg.URL, "name", msg.ServiceName)
+		}
+	default:
+		logging.Error(p.logger).Log(logging.MessageKey(), "Unexpected WRP Message. Please file an issue at github.com/xmidt-org/go-parodus/issues", "wrp", *msg)
+	}
+}
+
+// register adds the service, or refreshes it when it is already registered
+// with the same url. A service that registers again from a new url after it
+// went away, usually a restart on another port, gets a new forwarder in place
+// of the old one. While the service at the registered url is still alive, the
+// new registration is a conflict and is rejected.
+func (p *Parodus) register(name string, url string) {
+	p.lock.Lock()
+	existing := p.services[name]
+	var lastAlive time.Time
+	if existing != nil {
+		if existing.URL == url {
+			existing.LastAlive = time.Now()
+		}
+		lastAlive = existing.LastAlive
+	}
+	p.lock.Unlock()
+
+	if existing != nil && existing.URL == url {
+		logging.Debug(p.logger).Log(logging.MessageKey(), "updated registration timestamp", "url", url, "name", name)
+		return
+	}
+	// allow the keep alive answer to be a little late
+	if existing != nil && existing.Connected() && time.Since(lastAlive) <= 2*p.keepAlive {
+		logging.Error(p.logger).Log(logging.MessageKey(), "rejected conflicting service registration", "name", name,
+			"url", url, "registeredURL", existing.URL)
+		return
+	}
+
+	service, err := CreateServiceForwarder(name, url, p.keepAlive, p.queue, p.pending, p.logger)
+	if err != nil {
+		logging.Error(p.logger).Log(logging.MessageKey(), "failed to create service forwarder", logging.ErrorKey(), err, "url", url, "name", name)
+		return
+	}
+	replaced, err := p.attach(service)
+	if err != nil {
+		logging.Error(p.logger).Log(logging.MessageKey(), "failed to add service to registry", logging.ErrorKey(), err)
+		service.Close()
+		return
+	}
+	if replaced != nil {
+		replaced.Close()
+		logging.Info(p.logger).Log(logging.MessageKey(), "replaced service forwarder", "name", name, "oldURL", replaced.URL, "url", url,
+			"dropped", replaced.Dropped())
+	}
+	// let the new service know the current state of the cloud connection
+	p.sendConnectivity(service, p.connectivity.Current())
+}
+
+// attach adds the forwarder of a service and returns the one it replaced, if
+// any. The service register found may have been evicted in the meantime.
+func (p *Parodus) attach(service *Forwarder) (*Forwarder, error) {
+	// adding under the same name replaces the old forwarder in one step. The
+	// registry and services change together so an eviction sees both or
+	// neither.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.client.HandlerRegistry().Add(servicePattern(service.Name), service); err != nil {
+		return nil, err
+	}
+	replaced := p.services[service.Name]
+	p.services[service.Name] = service
+	if replaced != nil {
+		// the new instance subscribes again to the events it wants
+		p.subscriptions.RemoveService(service.Name)
+	}
+	return replaced, nil
+}
+
+// reap evicts the services that stopped answering keep alives, so requests
+// from the cloud are no longer routed to them.
+func (p *Parodus) reap() {
+	deadline := time.Duration(p.maxMissedKeepAlives) * p.keepAlive
+	p.lock.Lock()
+	var evicted []*Forwarder
+	var lastAlive []time.Time
+	var pending [][]pendingRequest
+	for _, service := range p.services {
+		if time.Since(service.LastAlive) > deadline {
+			evicted = append(evicted, service)
+			lastAlive = append(lastAlive, service.LastAlive)
+			pending = append(pending, p.detach(service))
+		}
+	}
+	p.lock.Unlock()
+
+	for i, service := range evicted {
+		logging.Info(p.logger).Log(logging.MessageKey(), "evicted service after missed keep alives", "name", service.Name,
+			"url", service.URL, "lastAlive", lastAlive[i], "missed", p.maxMissedKeepAlives, "dropped", service.Dropped())
+		p.closeService(service, pending[i], errServiceEvicted)
+	}
+}
+
+// deregister removes a service that is shutting down.
+func (p *Parodus) deregister(name string) {
+	p.lock.Lock()
+	service := p.services[name]
+	var pending []pendingRequest
+	if service != nil {
+		pending = p.detach(service)
+	}
+	p.lock.Unlock()
+	if service == nil {
+		logging.Debug(p.logger).Log(logging.MessageKey(), "deregistration of unknown service", "name", name)
+		return
+	}
+	logging.Info(p.logger).Log(logging.MessageKey(), "service deregistered", "name", name, "url", service.URL, "dropped", service.Dropped())
+	p.closeService(service, pending, errServiceDeregistered)
+}
+
+// detach takes a service out of services and the registry and returns the
+// requests it has not answered. The caller holds the lock, so a new
+// registration under the same name cannot slip in between and lose its
+// forwarder.
+func (p *Parodus) detach(service *Forwarder) []pendingRequest {
+	delete(p.services, service.Name)
+	p.client.HandlerRegistry().Remove(servicePattern(service.Name))
+	p.subscriptions.RemoveService(service.Name)
+	return p.pending.Remove(service.Name)
+}
+
+// closeService closes the forwarder of a detached service. The requests it has
+// not answered get an error response.
+func (p *Parodus) closeService(service *Forwarder, pending []pendingRequest, reason error) {
+	service.Close()
+	for _, pending := range pending {
+		request := pending.request
+		p.respond(pending, kratos.CreateErrorWRP(request.TransactionUUID, request.Source, request.Destination, http.StatusServiceUnavailable, reason))
+	}
+}
+
+// fail answers a request the service did not answer in time, or never got,
+// with an error. An answer the service may still send is dropped.
+func (p *Parodus) fail(pending pendingRequest, status int64, err error) {
+	request := pending.request
+	logging.Info(p.logger).Log(logging.MessageKey(), "failed service request", logging.ErrorKey(), err, "name", pending.service,
+		"transactionUUID", request.TransactionUUID, "destination", request.Destination, "status", status)
+	p.respond(pending, kratos.CreateErrorWRP(request.TransactionUUID, request.Source, request.Destination, status, err))
+}
+
+// route sends a message from a local service on. Answers to pending requests
+// go back to whoever asked, messages for parodus itself are answered here,
+// and messages for another service on this device are handed to it
+// directly. Everything else goes to the cloud, with a copy of the events for
+// the local services subscribed to them.
+func (p *Parodus) route(msg *wrp.Message) {
+	if pending, ok := p.pending.Complete(msg.TransactionUUID); ok && msg.TransactionUUID != "" {
+		p.respond(pending, msg)
+		return
+	}
+	if expectsResponse(msg) && p.pending.Late(msg.TransactionUUID) {
+		logging.Info(p.logger).Log(logging.MessageKey(), "dropped late response", "source", msg.Source,
+			"transactionUUID", msg.TransactionUUID)
+		return
+	}
+	switch {
+	case msg.Type == wrp.SimpleRequestResponseMessageType && msg.Destination == libparodus.CloudStatusDestination:
+		p.answerCloudStatus(msg)
+		return
+	case msg.Type != wrp.SimpleRequestResponseMessageType && msg.Type != wrp.SimpleEventMessageType && p.subscriptions.Matches(msg.Destination):
+		p.answerLocal(msg, p.subscriptions.HandleMessage(originService(msg), msg))
+		return
+	case msg.Type != wrp.SimpleRequestResponseMessageType && msg.Type != wrp.SimpleEventMessageType && p.self.Matches(msg.Destination):
+		p.answerLocal(msg, p.self.HandleMessage(msg))
+		return
+	}
+
+	if name, ok := p.localDestination(msg.Destination); ok {
+		p.lock.Lock()
+		target := p.services[name]
+		p.lock.Unlock()
+		if target != nil {
+			p.deliverLocal(target, msg)
+			return
+		}
+		logging.Debug(p.logger).Log(logging.MessageKey(), "no local service for destination, sending to the cloud", "destination", msg.Destination)
+	}
+	if msg.Type == wrp.SimpleEventMessageType {
+		p.publishLocal(msg)
+	}
+	p.upstream.Add(msg)
+	p.client.Send(msg)
+}
+
+// publishLocal sends a copy of an event to every local service subscribed to
+// it, other than the one that sent it.
+func (p *Parodus) publishLocal(msg *wrp.Message) {
+	sender := originService(msg)
+	for _, name := range p.subscriptions.Subscribers(msg.Destination) {
+		if name == sender {
+			continue
+		}
+		p.lock.Lock()
+		subscriber := p.services[name]
+		p.lock.Unlock()
+		if subscriber != nil {
+			subscriber.forward(msg)
+		}
+	}
+}
+
+// deliverLocal hands a message from one local service to another, keeping
+// track of requests so the answer finds its way back.
+func (p *Parodus) deliverLocal(target *Forwarder, msg *wrp.Message) {
+	// answers to local requests were completed by route
+	tracked := expectsResponse(msg)
+	if tracked {
+		p.pending.Add(target.Name, originService(msg), msg)
+	}
+	if err := target.forward(msg); err != nil && tracked {
+		if pending, ok := p.pending.Complete(msg.TransactionUUID); ok {
+			p.respond(pending, kratos.CreateErrorWRP(msg.TransactionUUID, msg.Source, msg.Destination, http.StatusServiceUnavailable, err))
+		}
+	}
+}
+
+// respond sends the response to a pending request to the cloud or to the
+// local service that made it.
+func (p *Parodus) respond(pending pendingRequest, response *wrp.Message) {
+	if pending.origin == "" {
+		p.client.Send(response)
+		return
+	}
+	p.lock.Lock()
+	origin := p.services[pending.origin]
+	p.lock.Unlock()
+	if origin == nil {
+		logging.Error(p.logger).Log(logging.MessageKey(), "dropped response for a service that is gone", "name", pending.origin,
+			"transactionUUID", response.TransactionUUID)
+		return
+	}
+	origin.forward(response)
+}
+
+// servicePattern is the registry pattern for the cloud requests for a
+// service, like mac:112233445566/service/path. It is anchored so a service
+// only gets its own requests, whatever the other services are called.
+func servicePattern(name string) string {
+	return "^[^/]+/" + regexp.QuoteMeta(name) + "(/.*)?$"
+}
+
+// localDestination reports whether the destination is a service on this
+// device, like mac:112233445566/service/path, and returns the service name.
+func (p *Parodus) localDestination(destination string) (string, bool) {
+	parts := strings.SplitN(destination, "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return "", false
+	}
+	id, err := wrp.ParseDeviceID(parts[0])
+	if err != nil || id != p.deviceID {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// publishConnectivity tells every registered service about each change of the
+// upstream connection state.
+func (p *Parodus) publishConnectivity(events <-chan ConnectionEvent) {
+	for {
+		select {
+		case <-p.stopHandling:
+			return
+		case event := <-events:
+			logging.Info(p.logger).Log(logging.MessageKey(), "cloud connection state changed", "state", event.State, "reason", event.Reason)
+			p.lock.Lock()
+			services := make([]*Forwarder, 0, len(p.services))
+			for _, service := range p.services {
+				services = append(services, service)
+			}
+			p.lock.Unlock()
+			for _, service := range services {
+				p.sendConnectivity(service, event)
+			}
+		}
+	}
+}
+
+func (p *Parodus) sendConnectivity(service *Forwarder, event ConnectionEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logging.Error(p.logger).Log(logging.MessageKey(), "failed to encode cloud status", logging.ErrorKey(), err)
+		return
+	}
+	service.forward(&wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      string(p.deviceID) + "/" + ParodusServiceName,
+		Destination: libparodus.CloudStatusEventPrefix + string(event.State),
+		ContentType: "application/json",
+		Payload:     payload,
+	})
+}
+
+// answerCloudStatus replies to a cloud status query from a local service.
+func (p *Parodus) answerCloudStatus(msg *wrp.Message) {
+	payload, err := json.Marshal(p.connectivity.Status())
+	if err != nil {
+		logging.Error(p.logger).Log(logging.MessageKey(), "failed to encode cloud status", logging.ErrorKey(), err)
+		return
+	}
+	status := int64(http.StatusOK)
+	p.answerLocal(msg, &wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          libparodus.CloudStatusDestination,
+		Destination:     msg.Source,
+		TransactionUUID: msg.TransactionUUID,
+		ContentType:     "application/json",
+		Payload:         payload,
+		Status:          &status,
+	})
+}
+
+// answerLocal sends the response to a request parodus answered itself back to
+// the local service that sent it.
+func (p *Parodus) answerLocal(request *wrp.Message, response *wrp.Message) {
+	name := originService(request)
+	p.lock.Lock()
+	service := p.services[name]
+	p.lock.Unlock()
+	if service == nil {
+		logging.Error(p.logger).Log(logging.MessageKey(), "request from unregistered service", "source", request.Source, "name", name)
+		return
+	}
+	service.forward(response)
+}
+
+// originService finds the local service that sent the message.
+func originService(msg *wrp.Message) string {
+	if msg.ServiceName != "" {
+		return msg.ServiceName
+	}
+	return localServiceName(msg.Source)
+}
+
+// localServiceName finds the service in a message source, which is either the
+// service name or a locator like mac:112233445566/service/path.
+func localServiceName(source string) string {
+	return localPath(source)[0]
+}
+
+// localPath splits a locator into the service name and the path after it.
+// Local services may leave out the device id, so mac:112233445566/parodus/tags
+// and parodus/tags both give parodus and tags.
+func localPath(locator string) []string {
+	parts := strings.Split(locator, "/")
+	if len(parts) > 1 && strings.Contains(parts[0], ":") {
+		return parts[1:]
+	}
+	return parts
+}
@@ -0,0 +1,373 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/xmidt-org/kratos"
+	"github.com/xmidt-org/wrp-go/v3"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+)
+
+// slowClient stands in for the upstream connection, taking sendDelay to send
+// each message.
+type slowClient struct {
+	registry  kratos.HandlerRegistry
+	sendDelay time.Duration
+	sent      sync.WaitGroup
+}
+
+func (c *slowClient) Hostname() string                        { return "" }
+func (c *slowClient) HandlerRegistry() kratos.HandlerRegistry { return c.registry }
+func (c *slowClient) Close() error                            { return nil }
+
+func (c *slowClient) Send(*wrp.Message) {
+	time.Sleep(c.sendDelay)
+	c.sent.Done()
+}
+
+func newBenchmarkParodus(b *testing.B, workers int, client kratos.Client) *Parodus {
+	p := &Parodus{
+		logger:        log.NewNopLogger(),
+		client:        client,
+		stopHandling:  make(chan struct{}),
+		keepAlive:     time.Hour,
+		workers:       workers,
+		services:      make(map[string]*Forwarder),
+		subscriptions: newEventSubscriptions(),
+		tags:          &tagStore{tags: nil},
+	}
+	p.upstream = ProvideUpstreamRequests()
+	p.pending = newPendingRequests(0, nil, p.upstream, p.fail)
+	b.Cleanup(func() { close(p.stopHandling) })
+	return p
+}
+
+// BenchmarkMsgHandler sends events from 16 local services to the cloud through
+// a slow upstream, showing how the workers handle services in parallel.
+func BenchmarkMsgHandler(b *testing.B) {
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			registry, err := kratos.NewHandlerRegistry(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			client := &slowClient{registry: registry, sendDelay: 50 * time.Microsecond}
+			p := newBenchmarkParodus(b, workers, client)
+			wrpBus := make(chan wrp.Message, workerQueueSize)
+			go p.msgHandler(wrpBus)
+
+			b.ResetTimer()
+			client.sent.Add(b.N)
+			for i := 0; i < b.N; i++ {
+				wrpBus <- wrp.Message{
+					Type:        wrp.SimpleEventMessageType,
+					Source:      fmt.Sprintf("service-%d", i%16),
+					Destination: "event:device-status",
+				}
+			}
+			client.sent.Wait()
+		})
+	}
+}
+
+func TestWorkerKeepsServiceOrder(t *testing.T) {
+	p := &Parodus{workers: 8}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("service-%d", i)
+		event := &wrp.Message{Type: wrp.SimpleEventMessageType, Source: "mac:112233445566/" + name + "/status"}
+		registration := &wrp.Message{Type: wrp.ServiceRegistrationMessageType, ServiceName: name}
+		if p.worker(event, p.workers) != p.worker(registration, p.workers) {
+			t.Fatalf("messages from %s go to different workers", name)
+		}
+	}
+}
+
+func TestRetrieveServices(t *testing.T) {
+	service := newQueueForwarder(QueueReject)
+	service.URL = "tcp://127.0.0.1:6667"
+	service.forward(&wrp.Message{Type: wrp.SimpleEventMessageType})
+	service.forward(&wrp.Message{Type: wrp.SimpleEventMessageType})
+	p := &Parodus{services: map[string]*Forwarder{"config": service}}
+	p.self = &selfHandler{parodus: p}
+
+	for _, destination := range []string{"mac:112233445566/parodus/services", "parodus/services/"} {
+		if !p.self.Matches(destination) {
+			t.Fatalf("%s is not for parodus", destination)
+		}
+		response := p.self.HandleMessage(&wrp.Message{Type: wrp.RetrieveMessageType, Destination: destination})
+		if response.Status == nil || *response.Status != http.StatusOK {
+			t.Fatalf("%s: unexpected response %+v", destination, response)
+		}
+		var status map[string]serviceStatus
+		if err := json.Unmarshal(response.Payload, &status); err != nil {
+			t.Fatal(err)
+		}
+		config := status["config"]
+		if len(status) != 1 || config.URL != service.URL || config.Queued != 1 || config.Dropped != 1 {
+			t.Fatalf("%s: unexpected status %+v", destination, status)
+		}
+	}
+
+	response := p.self.HandleMessage(&wrp.Message{Type: wrp.DeleteMessageType, Destination: "parodus/services"})
+	if response.Status == nil || *response.Status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected services to be read only, got %+v", response)
+	}
+}
+
+func TestParodusOnlyAnswersCRUD(t *testing.T) {
+	p := &Parodus{tags: &tagStore{tags: make(map[string]json.RawMessage)}}
+	p.self = &selfHandler{parodus: p}
+
+	event := &wrp.Message{Type: wrp.SimpleEventMessageType, Source: "dns:webpa.example.com", Destination: "mac:112233445566/parodus/tags"}
+	if response := p.self.HandleMessage(event); response != nil {
+		t.Fatalf("expected an event to be ignored, got %+v", response)
+	}
+
+	request := &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "request", Source: "dns:webpa.example.com",
+		Destination: "mac:112233445566/parodus/services"}
+	response := p.self.HandleMessage(request)
+	if response == nil || response.Type != wrp.SimpleRequestResponseMessageType || response.TransactionUUID != "request" ||
+		response.Destination != request.Source || response.Status == nil || *response.Status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected a request and response error, got %+v", response)
+	}
+}
+
+// newTestParodus returns a parodus without its own socket. What it sends to
+// the cloud goes to client.sent.
+func newTestParodus(t *testing.T) (*Parodus, *recordingClient) {
+	registry, err := kratos.NewHandlerRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &recordingClient{registry: registry, sent: make(chan *wrp.Message, 10)}
+	p := &Parodus{
+		logger:              log.NewNopLogger(),
+		deviceID:            "mac:112233445566",
+		client:              client,
+		connectivity:        ProvideConnectivity(),
+		keepAlive:           time.Hour,
+		maxMissedKeepAlives: 3,
+		queue:               QueueConfig{Size: 10, Policy: QueueReject},
+		services:            make(map[string]*Forwarder),
+		subscriptions:       newEventSubscriptions(),
+		upstream:            ProvideUpstreamRequests(),
+	}
+	p.pending = newPendingRequests(0, nil, p.upstream, p.fail)
+	t.Cleanup(func() {
+		for _, service := range p.services {
+			service.Close()
+		}
+	})
+	return p, client
+}
+
+// testService listens like a local service. received gets the requests and
+// answers parodus sends it, leaving out the cloud status events.
+type testService struct {
+	url      string
+	close    func()
+	received chan *wrp.Message
+}
+
+func newTestService(t *testing.T, name string) *testService {
+	sock, err := pull.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "inproc://" + t.Name() + "/" + name
+	if err := sock.Listen(url); err != nil {
+		t.Fatal(err)
+	}
+	service := &testService{url: url, close: func() { sock.Close() }, received: make(chan *wrp.Message, 10)}
+	t.Cleanup(service.close)
+	go func() {
+		for {
+			data, err := sock.Recv()
+			if err != nil {
+				return
+			}
+			var msg wrp.Message
+			if err := wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg); err != nil || msg.TransactionUUID == "" {
+				continue
+			}
+			service.received <- &msg
+		}
+	}()
+	return service
+}
+
+func (s *testService) expect(t *testing.T, transactionUUID string) *wrp.Message {
+	select {
+	case msg := <-s.received:
+		if msg.TransactionUUID != transactionUUID {
+			t.Fatalf("expected %s, got %+v", transactionUUID, msg)
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not get %s", s.url, transactionUUID)
+		return nil
+	}
+}
+
+// registered returns the forwarder of the service, checking the registry
+// agrees with the services.
+func registered(t *testing.T, p *Parodus, name string) *Forwarder {
+	p.lock.Lock()
+	service := p.services[name]
+	p.lock.Unlock()
+	handler, err := p.client.HandlerRegistry().GetHandler("mac:112233445566/" + name)
+	if service == nil {
+		if err == nil {
+			t.Fatalf("%s is gone but still in the registry", name)
+		}
+		return nil
+	}
+	if err != nil || handler != service {
+		t.Fatalf("the registry does not hold the forwarder of %s: %v", name, err)
+	}
+	return service
+}
+
+func TestRegisterReplacesServiceOnNewURL(t *testing.T) {
+	p, _ := newTestParodus(t)
+	first := newTestService(t, "config-1")
+	p.register("config", first.url)
+	old := registered(t, p, "config")
+	if old == nil || old.URL != first.url {
+		t.Fatalf("expected config at %s, got %+v", first.url, old)
+	}
+
+	// the service restarts on another url
+	first.close()
+	deadline := time.Now().Add(time.Second)
+	for old.Connected() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	second := newTestService(t, "config-2")
+	p.register("config", second.url)
+	service := registered(t, p, "config")
+	if service == nil || service == old || service.URL != second.url {
+		t.Fatalf("expected config to move to %s, got %+v", second.url, service)
+	}
+	select {
+	case <-old.stopTicker:
+	default:
+		t.Fatal("expected the old forwarder to be closed")
+	}
+
+	service.HandleMessage(&wrp.Message{Type: wrp.SimpleEventMessageType, TransactionUUID: "event", Destination: "mac:112233445566/config"})
+	second.expect(t, "event")
+}
+
+func TestRegisterRejectsConflict(t *testing.T) {
+	p, _ := newTestParodus(t)
+	first := newTestService(t, "config-1")
+	p.register("config", first.url)
+	live := registered(t, p, "config")
+
+	// the registered service still answers, so another one cannot take its name
+	p.register("config", newTestService(t, "config-2").url)
+	if service := registered(t, p, "config"); service != live {
+		t.Fatalf("expected config to stay at %s, got %+v", first.url, service)
+	}
+}
+
+func TestReapEvictsService(t *testing.T) {
+	p, client := newTestParodus(t)
+	p.register("config", newTestService(t, "config").url)
+	p.register("logs", newTestService(t, "logs").url)
+	config := registered(t, p, "config")
+	config.HandleMessage(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "request",
+		Source: "dns:webpa.example.com", Destination: "mac:112233445566/config"})
+
+	p.lock.Lock()
+	config.LastAlive = time.Now().Add(-4 * p.keepAlive)
+	p.lock.Unlock()
+	p.reap()
+
+	if registered(t, p, "config") != nil {
+		t.Fatal("expected config to be evicted")
+	}
+	if registered(t, p, "logs") == nil {
+		t.Fatal("expected logs to stay registered")
+	}
+	select {
+	case msg := <-client.sent:
+		if msg.TransactionUUID != "request" || msg.Status == nil || *msg.Status != http.StatusServiceUnavailable {
+			t.Fatalf("expected a 503 for the pending request, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pending request was not answered")
+	}
+}
+
+func TestReapWhileRegistering(t *testing.T) {
+	p, _ := newTestParodus(t)
+	p.register("config", newTestService(t, "config-1").url)
+	existing := registered(t, p, "config")
+
+	// register looked up existing, then the reaper evicts it before the new
+	// forwarder is attached
+	p.lock.Lock()
+	existing.LastAlive = time.Now().Add(-4 * p.keepAlive)
+	p.lock.Unlock()
+	p.reap()
+	service, err := CreateServiceForwarder("config", newTestService(t, "config-2").url, p.keepAlive, p.queue, p.pending, p.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := p.attach(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced != nil {
+		t.Fatalf("expected nothing to replace after the eviction, got %+v", replaced)
+	}
+	if registered(t, p, "config") != service {
+		t.Fatal("expected the new forwarder to be registered")
+	}
+}
+
+func TestLocalRequestIsAnsweredToOrigin(t *testing.T) {
+	p, client := newTestParodus(t)
+	config := newTestService(t, "config")
+	logs := newTestService(t, "logs")
+	p.register("config", config.url)
+	p.register("logs", logs.url)
+
+	p.route(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "local", Source: "mac:112233445566/logs",
+		Destination: "mac:112233445566/config/level"})
+	request := config.expect(t, "local")
+	if request.Source != "mac:112233445566/logs" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	p.pending.lock.Lock()
+	pending, ok := p.pending.requests["local"]
+	p.pending.lock.Unlock()
+	if !ok || pending.service != "config" || pending.origin != "logs" {
+		t.Fatalf("expected the request to wait for config to answer logs, got %+v", pending)
+	}
+
+	p.route(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "local", Source: "mac:112233445566/config",
+		Destination: "mac:112233445566/logs", Payload: []byte("debug")})
+	if answer := logs.expect(t, "local"); string(answer.Payload) != "debug" {
+		t.Fatalf("unexpected answer %+v", answer)
+	}
+	if _, ok := p.pending.Complete("local"); ok {
+		t.Fatal("expected the answer to complete the request")
+	}
+	select {
+	case msg := <-client.sent:
+		t.Fatalf("expected nothing to go to the cloud, got %+v", msg)
+	default:
+	}
+}
@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+)
+
+var (
+	errNoEndpointClaim = errors.New("jwt has no endpoint claim")
+	errNoTXTRecords    = errors.New("no TXT records found")
+)
+
+// EndpointResolver picks the talaria url to dial for a connection attempt.
+type EndpointResolver interface {
+	Endpoint(ctx context.Context) (string, error)
+}
+
+// EndpointResolverFunc is a function that is also an EndpointResolver.
+type EndpointResolverFunc func(ctx context.Context) (string, error)
+
+// Endpoint runs the EndpointResolverFunc.
+func (f EndpointResolverFunc) Endpoint(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// TXTResolver looks up DNS TXT records. *net.Resolver implements it, and a
+// resolver dialing a local stub server can be used in its place.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// ProvideEndpointResolvers creates a resolver for every --xmidt-url, in order
+// of preference. With --dns-txt-url the preferred url is only the fallback
+// for the endpoint found in the DNS TXT record.
+func ProvideEndpointResolvers(config Config, logger *zap.Logger) ([]EndpointResolver, error) {
+	return newEndpointResolvers(config, net.DefaultResolver, logger)
+}
+
+func newEndpointResolvers(config Config, txt TXTResolver, logger *zap.Logger) ([]EndpointResolver, error) {
+	resolvers := make([]EndpointResolver, 0, len(config.URLs))
+	for _, u := range config.URLs {
+		resolvers = append(resolvers, staticResolver(u))
+	}
+	if config.DNSTXTURL == "" || len(resolvers) == 0 {
+		return resolvers, nil
+	}
+	discovered, err := newDNSTXTResolver(config, txt, resolvers[0], logger)
+	if err != nil {
+		return nil, err
+	}
+	resolvers[0] = discovered
+	return resolvers, nil
+}
+
+func staticResolver(u string) EndpointResolver {
+	return EndpointResolverFunc(func(context.Context) (string, error) {
+		return u, nil
+	})
+}
+
+// dnsTXTResolver finds the talaria url in a signed JWT published in the DNS
+// TXT record for the device, like C parodus does with --dns-txt-url. The
+// fallback is used whenever the record is missing or fails verification.
+type dnsTXTResolver struct {
+	name      string
+	algorithm string
+	key       interface{}
+	resolver  TXTResolver
+	fallback  EndpointResolver
+	logger    *zap.Logger
+}
+
+type endpointClaims struct {
+	Endpoint string `json:"endpoint"`
+	jwt.RegisteredClaims
+}
+
+func newDNSTXTResolver(config Config, resolver TXTResolver, fallback EndpointResolver, logger *zap.Logger) (*dnsTXTResolver, error) {
+	data, err := os.ReadFile(config.JWTPublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", JWTPublicKeyFileKeyName, err)
+	}
+	key, err := parseJWTPublicKey(config.JWTAlgorithm, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", JWTPublicKeyFileKeyName, config.JWTPublicKeyFile, err)
+	}
+
+	return &dnsTXTResolver{
+		name:      strings.TrimPrefix(config.DeviceID, "mac:") + "." + config.DNSTXTURL,
+		algorithm: config.JWTAlgorithm,
+		key:       key,
+		resolver:  resolver,
+		fallback:  fallback,
+		logger:    logger,
+	}, nil
+}
+
+func (r *dnsTXTResolver) Endpoint(ctx context.Context) (string, error) {
+	endpoint, err := r.lookup(ctx)
+	if err != nil {
+		r.logger.Error("failed to discover talaria from dns txt record, using the default url", zap.String("name", r.name), zap.Error(err))
+		return r.fallback.Endpoint(ctx)
+	}
+	r.logger.Info("discovered talaria from dns txt record", zap.String("name", r.name), zap.String("url", endpoint))
+	return endpoint, nil
+}
+
+func (r *dnsTXTResolver) lookup(ctx context.Context) (string, error) {
+	records, err := r.resolver.LookupTXT(ctx, r.name)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", errNoTXTRecords
+	}
+
+	var claims endpointClaims
+	_, err = jwt.ParseWithClaims(joinTXTRecords(records), &claims, func(*jwt.Token) (interface{}, error) {
+		return r.key, nil
+	}, jwt.WithValidMethods([]string{r.algorithm}))
+	if err != nil {
+		return "", err
+	}
+	if claims.Endpoint == "" {
+		return "", errNoEndpointClaim
+	}
+
+	u, err := url.Parse(claims.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return "", fmt.Errorf("invalid endpoint scheme: %s", u.Scheme)
+	}
+	return strings.TrimSuffix(claims.Endpoint, "/") + XMIDTPathURL, nil
+}
+
+// joinTXTRecords rebuilds a JWT that was too long for a single TXT record.
+// When every record starts with a two digit index, like "00:", the records
+// are ordered by it; otherwise they are joined as returned.
+func joinTXTRecords(records []string) string {
+	indexed := make(map[int]string, len(records))
+	for _, record := range records {
+		if len(record) < 3 || record[2] != ':' {
+			return strings.Join(records, "")
+		}
+		i, err := strconv.Atoi(record[:2])
+		if err != nil {
+			return strings.Join(records, "")
+		}
+		indexed[i] = record[3:]
+	}
+
+	keys := make([]int, 0, len(indexed))
+	for i := range indexed {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	var token strings.Builder
+	for _, i := range keys {
+		token.WriteString(indexed[i])
+	}
+	return token.String()
+}
+
+func parseJWTPublicKey(algorithm string, data []byte) (interface{}, error) {
+	if jwt.GetSigningMethod(algorithm) == nil {
+		return nil, fmt.Errorf("unknown %s: %s", JWTAlgorithmKeyName, algorithm)
+	}
+	switch {
+	case strings.HasPrefix(algorithm, "RS"), strings.HasPrefix(algorithm, "PS"):
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	case strings.HasPrefix(algorithm, "ES"):
+		return jwt.ParseECPublicKeyFromPEM(data)
+	case algorithm == "EdDSA":
+		return jwt.ParseEdPublicKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("unsupported %s: %s", JWTAlgorithmKeyName, algorithm)
+	}
+}
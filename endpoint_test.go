@@ -0,0 +1,224 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	testTXTName  = "112233445566.talaria.example.com"
+	testFallback = "https://fallback.example.com"
+)
+
+// stubTXTResolver answers every lookup of its name with records, or with err.
+type stubTXTResolver struct {
+	records []string
+	err     error
+	names   []string
+}
+
+func (r *stubTXTResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	r.names = append(r.names, name)
+	if name != testTXTName {
+		return nil, fmt.Errorf("unexpected name %s", name)
+	}
+	return r.records, r.err
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writePublicKey writes the public half of key to a PEM file.
+func writePublicKey(t *testing.T, key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestDNSTXTResolver verifies the record with the public half of key.
+func newTestDNSTXTResolver(t *testing.T, key *rsa.PrivateKey, stub *stubTXTResolver) *dnsTXTResolver {
+	r, err := newDNSTXTResolver(Config{
+		DeviceID:         "mac:112233445566",
+		DNSTXTURL:        "talaria.example.com",
+		JWTAlgorithm:     "RS256",
+		JWTPublicKeyFile: writePublicKey(t, key),
+	}, stub, staticResolver(testFallback), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func signEndpoint(t *testing.T, method jwt.SigningMethod, key interface{}, endpoint string, expires time.Time) string {
+	token, err := jwt.NewWithClaims(method, endpointClaims{
+		Endpoint:         endpoint,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expires)},
+	}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestDNSTXTResolver(t *testing.T) {
+	key := newTestKey(t)
+	other := newTestKey(t)
+	later := time.Now().Add(time.Hour)
+	valid := signEndpoint(t, jwt.SigningMethodRS256, key, "https://talaria.example.com/", later)
+	discovered := "https://talaria.example.com" + XMIDTPathURL
+
+	tests := []struct {
+		name     string
+		stub     *stubTXTResolver
+		expected string
+	}{
+		{
+			name:     "valid",
+			stub:     &stubTXTResolver{records: []string{valid}},
+			expected: discovered,
+		},
+		{
+			name:     "bad signature",
+			stub:     &stubTXTResolver{records: []string{signEndpoint(t, jwt.SigningMethodRS256, other, "https://evil.example.com", later)}},
+			expected: testFallback,
+		},
+		{
+			name:     "wrong algorithm",
+			stub:     &stubTXTResolver{records: []string{signEndpoint(t, jwt.SigningMethodRS512, key, "https://talaria.example.com", later)}},
+			expected: testFallback,
+		},
+		{
+			name:     "none algorithm",
+			stub:     &stubTXTResolver{records: []string{signEndpoint(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "https://evil.example.com", later)}},
+			expected: testFallback,
+		},
+		{
+			name:     "expired",
+			stub:     &stubTXTResolver{records: []string{signEndpoint(t, jwt.SigningMethodRS256, key, "https://talaria.example.com", time.Now().Add(-time.Hour))}},
+			expected: testFallback,
+		},
+		{
+			name:     "invalid scheme",
+			stub:     &stubTXTResolver{records: []string{signEndpoint(t, jwt.SigningMethodRS256, key, "ftp://talaria.example.com", later)}},
+			expected: testFallback,
+		},
+		{
+			name:     "indexed records",
+			stub:     &stubTXTResolver{records: []string{"02:" + valid[200:], "00:" + valid[:100], "01:" + valid[100:200]}},
+			expected: discovered,
+		},
+		{
+			name:     "split records",
+			stub:     &stubTXTResolver{records: []string{valid[:100], valid[100:]}},
+			expected: discovered,
+		},
+		{
+			name:     "no records",
+			stub:     &stubTXTResolver{},
+			expected: testFallback,
+		},
+		{
+			name:     "lookup error",
+			stub:     &stubTXTResolver{err: errors.New("no such host")},
+			expected: testFallback,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestDNSTXTResolver(t, key, test.stub)
+			endpoint, err := r.Endpoint(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if endpoint != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, endpoint)
+			}
+			if len(test.stub.names) != 1 {
+				t.Fatalf("expected one lookup, got %v", test.stub.names)
+			}
+		})
+	}
+}
+
+func TestEndpointResolversFallBackToPreferredURL(t *testing.T) {
+	key := newTestKey(t)
+	config := Config{
+		DeviceID:         "mac:112233445566",
+		URLs:             []string{testFallback, "https://backup.example.com"},
+		DNSTXTURL:        "talaria.example.com",
+		JWTAlgorithm:     "RS256",
+		JWTPublicKeyFile: writePublicKey(t, key),
+	}
+	stub := &stubTXTResolver{err: errors.New("no such host")}
+	resolvers, err := newEndpointResolvers(config, stub, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range config.URLs {
+		endpoint, err := resolvers[i].Endpoint(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint != expected {
+			t.Fatalf("resolver %d: expected %s, got %s", i, expected, endpoint)
+		}
+	}
+	if len(stub.names) != 1 {
+		t.Fatalf("expected only the preferred url to look up the record, got %v", stub.names)
+	}
+
+	stub.err = nil
+	stub.records = []string{signEndpoint(t, jwt.SigningMethodRS256, key, "https://talaria.example.com", time.Now().Add(time.Hour))}
+	endpoint, err := resolvers[0].Endpoint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://talaria.example.com" + XMIDTPathURL; endpoint != expected {
+		t.Fatalf("expected %s, got %s", expected, endpoint)
+	}
+}
+
+func TestJoinTXTRecords(t *testing.T) {
+	tests := []struct {
+		records  []string
+		expected string
+	}{
+		{[]string{"abc"}, "abc"},
+		{[]string{"01:def", "00:abc"}, "abcdef"},
+		{[]string{"10:ghi", "00:abc", "01:def"}, "abcdefghi"},
+		// not every record is indexed, so they are joined as returned
+		{[]string{"01:def", "abc"}, "01:defabc"},
+		{[]string{"ab", "cd"}, "abcd"},
+	}
+	for _, test := range tests {
+		if got := joinTXTRecords(test.records); got != test.expected {
+			t.Errorf("joinTXTRecords(%q): expected %s, got %s", test.records, test.expected, got)
+		}
+	}
+}
@@ -4,8 +4,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/log"
@@ -14,6 +17,38 @@ import (
 	"github.com/xmidt-org/webpa-common/v2/logging" // nolint:staticcheck
 	"github.com/xmidt-org/wrp-go/v3"
 	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// QueuePolicy decides what happens to a message for a service whose queue is
+// full.
+type QueuePolicy string
+
+const (
+	// QueueBlock waits for the service to catch up, for up to
+	// queueBlockTimeout, then drops the new message like QueueReject.
+	QueueBlock QueuePolicy = "block"
+	// QueueDropOldest drops the oldest queued message to make room.
+	QueueDropOldest QueuePolicy = "drop-oldest"
+	// QueueReject drops the new message, answering it with a 503.
+	QueueReject QueuePolicy = "reject"
+)
+
+// QueueConfig bounds the messages waiting to be sent to each service.
+type QueueConfig struct {
+	Size   int
+	Policy QueuePolicy
+}
+
+const (
+	// How long QueueBlock waits for room in a full queue, so a stuck service
+	// cannot hold up the other services for good.
+	queueBlockTimeout = 5 * time.Second
+)
+
+var (
+	errQueueFull       = errors.New("service queue is full")
+	errForwarderClosed = errors.New("service forwarder is closed")
 )
 
 // Forwarder struct forwards messages coming from Talaria down to the libparouds clients
@@ -24,59 +59,191 @@ type Forwarder struct {
 	logger    log.Logger
 
 	stopTicker chan struct{}
+	closeOnce  sync.Once
 	sock       mangos.Socket
+	pipes      int32
+	pending    *pendingRequests
+
+	// messages wait in queue for the sender, so a slow service only holds
+	// up its own messages
+	queue        chan *wrp.Message
+	policy       QueuePolicy
+	blockTimeout time.Duration
+	dropped      uint64
 }
 
-func CreateServiceForwarder(name string, url string, logger log.Logger) (*Forwarder, error) {
-	sock, err := client.CreatePushSocket(url)
+// CreateServiceForwarder connects to the service and sends it a keep alive
+// every keepAlive, which the service answers to show it is still there. Cloud
+// requests handed to the service are tracked in pending until it answers.
+func CreateServiceForwarder(name string, url string, keepAlive time.Duration, queue QueueConfig, pending *pendingRequests, logger log.Logger) (*Forwarder, error) {
+	sock, err := push.NewSocket()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't get new push socket: %s", err)
 	}
 
 	quit := make(chan struct{})
 
 	forwarder := &Forwarder{
-		Name:       name,
-		URL:        url,
-		LastAlive:  time.Now(),
-		sock:       sock,
-		stopTicker: quit,
-		logger:     log.WithPrefix(logger, "forwarder", name),
+		Name:         name,
+		URL:          url,
+		LastAlive:    time.Now(),
+		sock:         sock,
+		stopTicker:   quit,
+		pending:      pending,
+		queue:        make(chan *wrp.Message, queue.Size),
+		policy:       queue.Policy,
+		blockTimeout: queueBlockTimeout,
+		logger:       log.WithPrefix(logger, "forwarder", name),
+	}
+	// the hook is set before dialing so the first pipe is counted
+	sock.SetPipeEventHook(func(event mangos.PipeEvent, pipe mangos.Pipe) {
+		switch event {
+		case mangos.PipeEventAttached:
+			atomic.AddInt32(&forwarder.pipes, 1)
+		case mangos.PipeEventDetached:
+			atomic.AddInt32(&forwarder.pipes, -1)
+		}
+		logging.Info(logger).Log(logging.MessageKey(), fmt.Sprintf("%s push socket event", name), "event", event, "pipe", pipe)
+	})
+	if err := sock.DialOptions(url, map[string]interface{}{mangos.OptionDialAsynch: false}); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("can't dial on push socket: %s", err)
 	}
-	ticker := time.NewTicker(5 * time.Second)
-	message := &wrp.Message{Type: wrp.ServiceAliveMessageType}
+
+	go forwarder.send()
+
+	ticker := time.NewTicker(keepAlive)
+	// the service echoes the name back, so parodus knows who is alive
+	message := &wrp.Message{Type: wrp.ServiceAliveMessageType, ServiceName: name}
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
-				// do stuff
-				forwarder.HandleMessage(message)
+				forwarder.forward(message)
 			case <-quit:
 				ticker.Stop()
 				return
 			}
 		}
 	}()
-	sock.SetPipeEventHook(func(event mangos.PipeEvent, pipe mangos.Pipe) {
-		logging.Info(logger).Log(logging.MessageKey(), fmt.Sprintf("%s push socket event", name), "event", event, "pipe", pipe)
-	})
 	return forwarder, nil
 }
 
+// HandleMessage forwards a message from the cloud to the service.
 func (forwarder *Forwarder) HandleMessage(message *wrp.Message) *wrp.Message {
-	logging.Debug(forwarder.logger).Log(logging.MessageKey(), "handling message", "wrp", *message)
-	err := client.SendMessage(forwarder.sock, *message)
-	if err != nil {
-		logging.Error(forwarder.logger).Log(logging.MessageKey(), "failed to send message", logging.ErrorKey(), err)
+	tracked := forwarder.pending.IsRequest(message)
+	if tracked {
+		forwarder.pending.Add(forwarder.Name, "", message)
+	}
+	if err := forwarder.forward(message); err != nil {
+		if tracked {
+			forwarder.pending.Complete(message.TransactionUUID)
+		}
 		return kratos.CreateErrorWRP(message.TransactionUUID, message.Source, message.Destination, http.StatusServiceUnavailable, err)
 	}
 	return nil
 }
 
-func (forwarder *Forwarder) Close() {
-	forwarder.stopTicker <- struct{}{}
-	err := forwarder.sock.Close()
-	if err != nil {
-		logging.Error(forwarder.logger).Log(logging.MessageKey(), "failed to close socket", logging.ErrorKey(), err)
+// forward queues the message for the service, without waiting for it to be
+// sent. What happens when the queue is full depends on the policy.
+func (forwarder *Forwarder) forward(message *wrp.Message) error {
+	logging.Debug(forwarder.logger).Log(logging.MessageKey(), "handling message", "wrp", *message)
+	select {
+	case <-forwarder.stopTicker:
+		return errForwarderClosed
+	default:
+	}
+	select {
+	case forwarder.queue <- message:
+		return nil
+	default:
 	}
+
+	switch forwarder.policy {
+	case QueueDropOldest:
+		// the sender may take the oldest first, leaving room without a drop
+		for {
+			select {
+			case forwarder.queue <- message:
+				return nil
+			default:
+			}
+			select {
+			case oldest := <-forwarder.queue:
+				forwarder.drop(oldest)
+			default:
+			}
+		}
+	case QueueReject:
+		forwarder.drop(nil)
+		return errQueueFull
+	default:
+		timer := time.NewTimer(forwarder.blockTimeout)
+		defer timer.Stop()
+		select {
+		case forwarder.queue <- message:
+			return nil
+		case <-forwarder.stopTicker:
+			return errForwarderClosed
+		case <-timer.C:
+			forwarder.drop(nil)
+			return errQueueFull
+		}
+	}
+}
+
+// drop counts a message lost to a full queue. A dropped request is answered
+// with a 503 rather than left to time out.
+func (forwarder *Forwarder) drop(message *wrp.Message) {
+	dropped := atomic.AddUint64(&forwarder.dropped, 1)
+	logging.Warn(forwarder.logger).Log(logging.MessageKey(), "service queue full, dropped a message", "policy", forwarder.policy,
+		"dropped", dropped)
+	if message != nil && expectsResponse(message) {
+		forwarder.pending.Fail(message.TransactionUUID, http.StatusServiceUnavailable, errQueueFull)
+	}
+}
+
+// send writes the queued messages to the service until the forwarder is
+// closed.
+func (forwarder *Forwarder) send() {
+	for {
+		select {
+		case <-forwarder.stopTicker:
+			return
+		case message := <-forwarder.queue:
+			if err := client.SendMessage(forwarder.sock, *message); err != nil {
+				logging.Error(forwarder.logger).Log(logging.MessageKey(), "failed to send message", logging.ErrorKey(), err)
+				if expectsResponse(message) {
+					forwarder.pending.Fail(message.TransactionUUID, http.StatusServiceUnavailable, err)
+				}
+			}
+		}
+	}
+}
+
+// Queued returns the number of messages waiting to be sent to the service.
+func (forwarder *Forwarder) Queued() int {
+	return len(forwarder.queue)
+}
+
+// Dropped returns the number of messages lost to a full queue so far.
+func (forwarder *Forwarder) Dropped() uint64 {
+	return atomic.LoadUint64(&forwarder.dropped)
+}
+
+// Connected reports whether the service is still listening on its url.
+func (forwarder *Forwarder) Connected() bool {
+	return atomic.LoadInt32(&forwarder.pipes) > 0
+}
+
+// Close stops the keep alives and the sender and closes the push socket.
+// Messages still queued are not sent. It is safe to call more than once.
+func (forwarder *Forwarder) Close() {
+	forwarder.closeOnce.Do(func() {
+		close(forwarder.stopTicker)
+		err := forwarder.sock.Close()
+		if err != nil {
+			logging.Error(forwarder.logger).Log(logging.MessageKey(), "failed to close socket", logging.ErrorKey(), err)
+		}
+	})
 }
@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// newQueueForwarder returns a forwarder without a sender, so its queue stays
+// full.
+func newQueueForwarder(policy QueuePolicy) *Forwarder {
+	return &Forwarder{
+		Name:         "config",
+		logger:       log.NewNopLogger(),
+		stopTicker:   make(chan struct{}),
+		pending:      newPendingRequests(0, nil, ProvideUpstreamRequests(), func(pendingRequest, int64, error) {}),
+		queue:        make(chan *wrp.Message, 1),
+		policy:       policy,
+		blockTimeout: 50 * time.Millisecond,
+	}
+}
+
+func TestForwarderQueuePolicies(t *testing.T) {
+	first := &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:first"}
+	second := &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:second"}
+	tests := []struct {
+		policy QueuePolicy
+		err    error
+		queued *wrp.Message
+	}{
+		{QueueDropOldest, nil, second},
+		{QueueReject, errQueueFull, first},
+		{QueueBlock, errQueueFull, first},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			forwarder := newQueueForwarder(test.policy)
+			if err := forwarder.forward(first); err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error)
+			go func() { done <- forwarder.forward(second) }()
+			select {
+			case err := <-done:
+				if err != test.err {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("forward is stuck on a full queue")
+			}
+			if forwarder.Dropped() != 1 || forwarder.Queued() != 1 {
+				t.Fatalf("expected 1 dropped and 1 queued, got %d and %d", forwarder.Dropped(), forwarder.Queued())
+			}
+			if queued := <-forwarder.queue; queued != test.queued {
+				t.Fatalf("expected %s queued, got %s", test.queued.Destination, queued.Destination)
+			}
+		})
+	}
+}
+
+func TestForwarderBlockStopsOnClose(t *testing.T) {
+	forwarder := newQueueForwarder(QueueBlock)
+	forwarder.blockTimeout = time.Hour
+	forwarder.forward(&wrp.Message{Type: wrp.SimpleEventMessageType})
+	done := make(chan error)
+	go func() { done <- forwarder.forward(&wrp.Message{Type: wrp.SimpleEventMessageType}) }()
+	close(forwarder.stopTicker)
+	select {
+	case err := <-done:
+		if err != errForwarderClosed {
+			t.Fatalf("expected %v, got %v", errForwarderClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("forward kept waiting after the forwarder was closed")
+	}
+}
@@ -5,6 +5,9 @@ go 1.19
 require (
 	github.com/go-kit/kit v0.12.0
 	github.com/go-kit/log v0.2.1
+	github.com/golang-jwt/jwt/v4 v4.3.0
+	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/spf13/pflag v1.0.5
 	github.com/xmidt-org/kratos v0.3.0
 	github.com/xmidt-org/themis v0.4.11
@@ -20,9 +23,7 @@ require (
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/goph/emperror v0.17.3-0.20190703203600-60a8d9faa17b // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.6 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
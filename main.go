@@ -34,6 +34,10 @@ func main() {
 			Provide,
 			config.ProvideViper(),
 			xlog.Unmarshal("log"),
+			ProvideEndpointResolvers,
+			ProvideConnectivity,
+			ProvideUpstreamRequests,
+			ProvideSelfHandler,
 			StartUpstreamConnection,
 		),
 		fx.Invoke(
@@ -0,0 +1,227 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// How long the transaction uuid of an expired request is remembered, so
+	// a late answer is dropped instead of being routed as a new message. It
+	// is also how long parodus waits for the answer to a request sent to the
+	// cloud.
+	lateResponseWindow = 5 * time.Minute
+)
+
+var (
+	errRequestTimeout = errors.New("service did not answer in time")
+)
+
+// pendingRequests tracks the requests handed to local services that have not
+// been answered yet, by transaction uuid. A request comes from the cloud or,
+// when origin is set, from another local service. A request the service does
+// not answer before its deadline, or that never reached it, is handed to fail
+// to be answered with an error.
+type pendingRequests struct {
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+	upstream *upstreamRequests
+	fail     func(pending pendingRequest, status int64, err error)
+
+	lock     sync.Mutex
+	requests map[string]pendingRequest
+	expired  map[string]struct{}
+}
+
+type pendingRequest struct {
+	service string
+	origin  string
+	request *wrp.Message
+	timer   *time.Timer
+}
+
+// newPendingRequests gives the requests to a service the deadline in
+// timeouts, or timeout for the other services. A request without a deadline
+// waits as long as the service is registered.
+func newPendingRequests(timeout time.Duration, timeouts map[string]time.Duration, upstream *upstreamRequests,
+	fail func(pendingRequest, int64, error)) *pendingRequests {
+	return &pendingRequests{
+		timeout:  timeout,
+		timeouts: timeouts,
+		upstream: upstream,
+		fail:     fail,
+		requests: make(map[string]pendingRequest),
+		expired:  make(map[string]struct{}),
+	}
+}
+
+// expectsResponse reports whether the service is expected to answer the
+// message.
+func expectsResponse(msg *wrp.Message) bool {
+	if msg.TransactionUUID == "" {
+		return false
+	}
+	switch msg.Type {
+	case wrp.SimpleRequestResponseMessageType, wrp.CreateMessageType, wrp.RetrieveMessageType,
+		wrp.UpdateMessageType, wrp.DeleteMessageType:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsRequest reports whether the message is a request the service has to
+// answer, rather than the answer to a request.
+func (p *pendingRequests) IsRequest(msg *wrp.Message) bool {
+	return p.upstream.IsRequest(msg)
+}
+
+// Add records a request handed to the service, from the origin service or,
+// when origin is empty, from the cloud.
+func (p *pendingRequests) Add(service string, origin string, msg *wrp.Message) {
+	pending := pendingRequest{service: service, origin: origin, request: msg}
+	timeout, ok := p.timeouts[service]
+	if !ok {
+		timeout = p.timeout
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if timeout > 0 {
+		pending.timer = time.AfterFunc(timeout, func() { p.timeoutRequest(msg) })
+	}
+	p.requests[msg.TransactionUUID] = pending
+}
+
+// timeoutRequest expires the request when it is still waiting for an answer.
+func (p *pendingRequests) timeoutRequest(msg *wrp.Message) {
+	p.lock.Lock()
+	pending, ok := p.requests[msg.TransactionUUID]
+	// the uuid may have been reused by a newer request
+	if !ok || pending.request != msg {
+		p.lock.Unlock()
+		return
+	}
+	delete(p.requests, msg.TransactionUUID)
+	p.expired[msg.TransactionUUID] = struct{}{}
+	p.lock.Unlock()
+
+	time.AfterFunc(lateResponseWindow, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		delete(p.expired, msg.TransactionUUID)
+	})
+	p.fail(pending, http.StatusGatewayTimeout, errRequestTimeout)
+}
+
+// Fail answers the request with the transaction uuid with an error, when it
+// is still pending.
+func (p *pendingRequests) Fail(transactionUUID string, status int64, err error) {
+	if pending, ok := p.Complete(transactionUUID); ok {
+		p.fail(pending, status, err)
+	}
+}
+
+// Late reports whether the transaction uuid belongs to a request that expired
+// recently, so its answer has to be dropped.
+func (p *pendingRequests) Late(transactionUUID string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.expired[transactionUUID]
+	return ok
+}
+
+// Complete forgets the request answered by the response with the transaction
+// uuid, returning it when it was pending.
+func (p *pendingRequests) Complete(transactionUUID string) (pendingRequest, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pending, ok := p.requests[transactionUUID]
+	if ok {
+		pending.stop()
+		delete(p.requests, transactionUUID)
+	}
+	return pending, ok
+}
+
+// Remove forgets every request pending for the service and returns them, so
+// they can be answered with an error.
+func (p *pendingRequests) Remove(service string) []pendingRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var requests []pendingRequest
+	for transactionUUID, pending := range p.requests {
+		if pending.service == service {
+			pending.stop()
+			requests = append(requests, pending)
+			delete(p.requests, transactionUUID)
+		}
+	}
+	return requests
+}
+
+func (p pendingRequest) stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// upstreamRequests remembers the requests local services sent to the cloud,
+// by transaction uuid, so the answers coming back are not taken for new
+// requests from the cloud. Each request is answered once: the first message
+// from the cloud with its transaction uuid takes the place of the answer, any
+// other one is a request.
+type upstreamRequests struct {
+	lock sync.Mutex
+	// the answer by transaction uuid, nil while it is waited for
+	uuids map[string]*wrp.Message
+}
+
+func ProvideUpstreamRequests() *upstreamRequests {
+	return &upstreamRequests{
+		uuids: make(map[string]*wrp.Message),
+	}
+}
+
+// Add remembers the message when it is a request, for as long as its answer
+// is waited for.
+func (r *upstreamRequests) Add(msg *wrp.Message) {
+	if !expectsResponse(msg) || msg.Status != nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.uuids[msg.TransactionUUID] = nil
+	time.AfterFunc(lateResponseWindow, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.uuids, msg.TransactionUUID)
+	})
+}
+
+// IsRequest reports whether a message from the cloud is a request, rather
+// than the answer to a request sent to the cloud. Asking again about the same
+// message gives the same result.
+func (r *upstreamRequests) IsRequest(msg *wrp.Message) bool {
+	if !expectsResponse(msg) {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	answer, ok := r.uuids[msg.TransactionUUID]
+	if !ok {
+		return true
+	}
+	if answer == nil {
+		r.uuids[msg.TransactionUUID] = msg
+		return false
+	}
+	return answer != msg
+}
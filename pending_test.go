@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/xmidt-org/kratos"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestUpstreamRequestsTellAnswersFromRequests(t *testing.T) {
+	upstream := ProvideUpstreamRequests()
+	sent := &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent"}
+	upstream.Add(sent)
+
+	status := int64(200)
+	tests := []struct {
+		name    string
+		msg     *wrp.Message
+		request bool
+	}{
+		{"request", &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "new"}, true},
+		{"crud request", &wrp.Message{Type: wrp.RetrieveMessageType, TransactionUUID: "new"}, true},
+		{"answer to a request sent upstream", &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent"}, false},
+		{"status without a request sent upstream", &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "new", Status: &status}, true},
+		{"event", &wrp.Message{Type: wrp.SimpleEventMessageType, TransactionUUID: "new"}, false},
+		{"no transaction", &wrp.Message{Type: wrp.SimpleRequestResponseMessageType}, false},
+	}
+	for _, test := range tests {
+		if got := upstream.IsRequest(test.msg); got != test.request {
+			t.Errorf("%s: expected IsRequest %v, got %v", test.name, test.request, got)
+		}
+	}
+}
+
+func TestUpstreamRequestsAreAnsweredOnce(t *testing.T) {
+	upstream := ProvideUpstreamRequests()
+	upstream.Add(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent"})
+
+	answer := &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent"}
+	if upstream.IsRequest(answer) || upstream.IsRequest(answer) {
+		t.Fatal("expected the first message with the uuid to be the answer")
+	}
+	if !upstream.IsRequest(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "sent"}) {
+		t.Fatal("expected another message with the uuid to be a request")
+	}
+}
+
+// recordingClient stands in for the upstream connection, handing every message
+// sent to the cloud to sent.
+type recordingClient struct {
+	registry kratos.HandlerRegistry
+	sent     chan *wrp.Message
+}
+
+func (c *recordingClient) Hostname() string                        { return "" }
+func (c *recordingClient) HandlerRegistry() kratos.HandlerRegistry { return c.registry }
+func (c *recordingClient) Close() error                            { return nil }
+func (c *recordingClient) Send(msg *wrp.Message)                   { c.sent <- msg }
+
+func TestRequestTimeoutOverrides(t *testing.T) {
+	config := provideTestConfig(t, "--service-request-timeout=10", "--service-request-timeouts=config=2,logs=0")
+	timeout, timeouts := requestTimeouts(config)
+	if timeout != 10*time.Second {
+		t.Fatalf("expected a 10s timeout, got %s", timeout)
+	}
+	if len(timeouts) != 2 || timeouts["config"] != 2*time.Second || timeouts["logs"] != 0 {
+		t.Fatalf("unexpected overrides %v", timeouts)
+	}
+}
+
+func TestPendingRequestTimesOut(t *testing.T) {
+	client := &recordingClient{sent: make(chan *wrp.Message, 10)}
+	p := &Parodus{
+		logger:   log.NewNopLogger(),
+		client:   client,
+		services: make(map[string]*Forwarder),
+		upstream: ProvideUpstreamRequests(),
+	}
+	p.pending = newPendingRequests(time.Hour, map[string]time.Duration{"config": 20 * time.Millisecond, "logs": 0}, p.upstream, p.fail)
+	for _, name := range []string{"config", "logs", "other"} {
+		service := newQueueForwarder(QueueReject)
+		service.Name = name
+		service.pending = p.pending
+		p.services[name] = service
+	}
+
+	for _, name := range []string{"config", "logs", "other"} {
+		request := &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: name, Source: "dns:webpa.example.com",
+			Destination: "mac:112233445566/" + name}
+		if response := p.services[name].HandleMessage(request); response != nil {
+			t.Fatalf("%s: unexpected response %+v", name, response)
+		}
+	}
+
+	select {
+	case msg := <-client.sent:
+		if msg.TransactionUUID != "config" || msg.Destination != "dns:webpa.example.com" || msg.Status == nil || *msg.Status != http.StatusGatewayTimeout {
+			t.Fatalf("expected a 504 for the config request, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the config request did not time out")
+	}
+
+	// the answer after the 504 is dropped, not sent as a new message
+	p.route(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "config", Source: "mac:112233445566/config",
+		Destination: "dns:webpa.example.com", Payload: []byte("late")})
+	select {
+	case msg := <-client.sent:
+		t.Fatalf("expected the late answer to be dropped, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// logs waits forever and other has the default of an hour
+	for _, name := range []string{"logs", "other"} {
+		pending, ok := p.pending.Complete(name)
+		if !ok {
+			t.Fatalf("expected the %s request to be pending", name)
+		}
+		if (pending.timer == nil) != (name == "logs") {
+			t.Fatalf("%s: unexpected deadline", name)
+		}
+	}
+}
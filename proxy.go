@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ProxyFunc picks the proxy for a request, like http.Transport.Proxy.
+type ProxyFunc func(*http.Request) (*url.URL, error)
+
+// newProxy returns the proxy the upstream websocket tunnels through. --proxy
+// wins over the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+// Either may be an http url, for an HTTP CONNECT tunnel, or a socks5 url.
+// The credentials file is only used for a proxy url without its own.
+func newProxy(config Config, logger *zap.Logger) (ProxyFunc, error) {
+	var user *url.Userinfo
+	if config.ProxyCredentialsFile != "" {
+		var err error
+		if user, err = loadProxyCredentials(config.ProxyCredentialsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Proxy != "" {
+		proxyURL, err := parseProxyURL(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ProxyKeyName, err)
+		}
+		proxyURL = withUser(proxyURL, user)
+		logger.Info("tunneling upstream through proxy", zap.String("proxy", proxyURL.Redacted()))
+		return http.ProxyURL(proxyURL), nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := http.ProxyFromEnvironment(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		if err := checkProxyScheme(proxyURL); err != nil {
+			return nil, err
+		}
+		return withUser(proxyURL, user), nil
+	}, nil
+}
+
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProxyScheme(proxyURL); err != nil {
+		return nil, err
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy url %s has no host", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+// checkProxyScheme rejects the proxies the websocket dialer cannot use.
+func checkProxyScheme(proxyURL *url.URL) error {
+	switch proxyURL.Scheme {
+	case "http", "socks5":
+		return nil
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q, must be http or socks5", proxyURL.Scheme)
+	}
+}
+
+func withUser(proxyURL *url.URL, user *url.Userinfo) *url.URL {
+	if user == nil || proxyURL.User != nil {
+		return proxyURL
+	}
+	withUser := *proxyURL
+	withUser.User = user
+	return &withUser
+}
+
+// loadProxyCredentials reads a user:password pair from the first line of the
+// file, so the password does not show up in the process list.
+func loadProxyCredentials(path string) (*url.Userinfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ProxyCredentialsFileKeyName, err)
+	}
+	line := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	name, password, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("%s must hold user:password", ProxyCredentialsFileKeyName)
+	}
+	return url.UserPassword(name, password), nil
+}
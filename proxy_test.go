@@ -0,0 +1,334 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	testProxyUser     = "parodus"
+	testProxyPassword = "s3cret"
+
+	// testTalariaURL is never resolved, the test proxies send every tunnel
+	// to the local websocket server.
+	testTalariaURL = "ws://talaria.test" + XMIDTPathURL
+)
+
+// testProxy tunnels every connection to target, once the client passed the
+// handshake. tunnels receives the address each client asked for.
+type testProxy struct {
+	listener net.Listener
+	target   string
+	user     *url.Userinfo
+	tunnels  chan string
+}
+
+// newWebsocketServer starts a server accepting websocket upgrades and returns
+// its address.
+func newWebsocketServer(t *testing.T) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+func startTestProxy(t *testing.T, user *url.Userinfo, handshake func(*testProxy, net.Conn) (string, error)) *testProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	proxy := &testProxy{
+		listener: listener,
+		target:   newWebsocketServer(t),
+		user:     user,
+		tunnels:  make(chan string, 10),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, err := handshake(proxy, conn)
+				if err != nil {
+					return
+				}
+				proxy.tunnels <- addr
+				proxy.splice(conn)
+			}()
+		}
+	}()
+	return proxy
+}
+
+func (p *testProxy) splice(conn net.Conn) {
+	target, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func (p *testProxy) allowed(name string, password string) bool {
+	if p.user == nil {
+		return true
+	}
+	want, _ := p.user.Password()
+	return name == p.user.Username() && password == want
+}
+
+// newConnectProxy starts an HTTP proxy answering CONNECT requests.
+func newConnectProxy(t *testing.T, user *url.Userinfo) *testProxy {
+	return startTestProxy(t, user, func(p *testProxy, conn net.Conn) (string, error) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+			return "", errors.New("not a CONNECT request")
+		}
+		var name, password string
+		if auth := req.Header.Get("Proxy-Authorization"); strings.HasPrefix(auth, "Basic ") {
+			if decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic ")); err == nil {
+				name, password, _ = strings.Cut(string(decoded), ":")
+			}
+		}
+		if !p.allowed(name, password) {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", errors.New("bad credentials")
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, err
+	})
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy, asking for the user and password of
+// RFC 1929 when user is set.
+func newSOCKS5Proxy(t *testing.T, user *url.Userinfo) *testProxy {
+	return startTestProxy(t, user, func(p *testProxy, conn net.Conn) (string, error) {
+		r := bufio.NewReader(conn)
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil || header[0] != 5 {
+			return "", errors.New("not a SOCKS5 greeting")
+		}
+		if _, err := io.ReadFull(r, make([]byte, header[1])); err != nil {
+			return "", err
+		}
+		if p.user == nil {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			name, password, err := readSOCKS5Credentials(r)
+			if err != nil {
+				return "", err
+			}
+			if !p.allowed(name, password) {
+				conn.Write([]byte{1, 1})
+				return "", errors.New("bad credentials")
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(r, request); err != nil || request[1] != 1 {
+			return "", errors.New("not a CONNECT request")
+		}
+		var host string
+		switch request[3] {
+		case 1, 4:
+			ip := make([]byte, 4)
+			if request[3] == 4 {
+				ip = make([]byte, 16)
+			}
+			if _, err := io.ReadFull(r, ip); err != nil {
+				return "", err
+			}
+			host = net.IP(ip).String()
+		case 3:
+			name, err := readSOCKS5String(r)
+			if err != nil {
+				return "", err
+			}
+			host = name
+		default:
+			return "", errors.New("unknown address type")
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(r, port); err != nil {
+			return "", err
+		}
+		_, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), err
+	})
+}
+
+func readSOCKS5Credentials(r *bufio.Reader) (string, string, error) {
+	if version, err := r.ReadByte(); err != nil || version != 1 {
+		return "", "", errors.New("not a user and password negotiation")
+	}
+	name, err := readSOCKS5String(r)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readSOCKS5String(r)
+	return name, password, err
+}
+
+func readSOCKS5String(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func writeProxyCredentials(t *testing.T, credentials string) string {
+	path := filepath.Join(t.TempDir(), "proxy-credentials")
+	if err := os.WriteFile(path, []byte(credentials+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// dialThrough dials talaria with the dialer built from config, and returns
+// the address the proxy was asked for.
+func dialThrough(t *testing.T, config Config, proxy *testProxy) (string, error) {
+	dialer, err := newDialer(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialer.Dial(testTalariaURL, nil)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	select {
+	case addr := <-proxy.tunnels:
+		return addr, nil
+	default:
+		t.Fatal("the connection did not go through the proxy")
+		return "", nil
+	}
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	user := url.UserPassword(testProxyUser, testProxyPassword)
+	proxies := []struct {
+		scheme string
+		start  func(*testing.T, *url.Userinfo) *testProxy
+	}{
+		{"http", newConnectProxy},
+		{"socks5", newSOCKS5Proxy},
+	}
+	for _, p := range proxies {
+		t.Run(p.scheme, func(t *testing.T) {
+			t.Run("no credentials", func(t *testing.T) {
+				proxy := p.start(t, nil)
+				addr, err := dialThrough(t, Config{Proxy: p.scheme + "://" + proxy.listener.Addr().String()}, proxy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if addr != "talaria.test:80" {
+					t.Fatalf("expected a tunnel to talaria.test:80, got %s", addr)
+				}
+			})
+			t.Run("credentials in url", func(t *testing.T) {
+				proxy := p.start(t, user)
+				proxyURL := p.scheme + "://" + user.String() + "@" + proxy.listener.Addr().String()
+				if _, err := dialThrough(t, Config{Proxy: proxyURL}, proxy); err != nil {
+					t.Fatal(err)
+				}
+			})
+			t.Run("credentials file", func(t *testing.T) {
+				proxy := p.start(t, user)
+				if _, err := dialThrough(t, Config{
+					Proxy:                p.scheme + "://" + proxy.listener.Addr().String(),
+					ProxyCredentialsFile: writeProxyCredentials(t, testProxyUser+":"+testProxyPassword),
+				}, proxy); err != nil {
+					t.Fatal(err)
+				}
+			})
+			t.Run("wrong credentials", func(t *testing.T) {
+				proxy := p.start(t, user)
+				if _, err := dialThrough(t, Config{
+					Proxy:                p.scheme + "://" + proxy.listener.Addr().String(),
+					ProxyCredentialsFile: writeProxyCredentials(t, testProxyUser+":wrong"),
+				}, proxy); err == nil {
+					t.Fatal("expected the proxy to refuse the connection")
+				}
+			})
+		})
+	}
+}
+
+// http.ProxyFromEnvironment reads the environment only once per process, so
+// the environment is tested in a process of its own.
+const proxyEnvTestKey = "PARODUS_PROXY_ENV_TEST"
+
+func TestDialThroughProxyFromEnvironment(t *testing.T) {
+	if os.Getenv(proxyEnvTestKey) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDialThroughProxyFromEnvironment$", "-test.v")
+		cmd.Env = append(os.Environ(), proxyEnvTestKey+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	user := url.UserPassword(testProxyUser, testProxyPassword)
+	proxy := newConnectProxy(t, user)
+	t.Setenv("HTTP_PROXY", "http://"+proxy.listener.Addr().String())
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("NO_PROXY", "direct.test")
+	config := Config{ProxyCredentialsFile: writeProxyCredentials(t, testProxyUser+":"+testProxyPassword)}
+
+	addr, err := dialThrough(t, config, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "talaria.test:80" {
+		t.Fatalf("expected a tunnel to talaria.test:80, got %s", addr)
+	}
+
+	proxyFunc, err := newProxy(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://direct.test", nil)
+	if proxyURL, err := proxyFunc(req); err != nil || proxyURL != nil {
+		t.Fatalf("expected no proxy for a NO_PROXY host, got %v: %v", proxyURL, err)
+	}
+}
@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xmidt-org/kratos"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// ServicesPath is the path, under the parodus service, of the state of the
+// registered local services.
+const ServicesPath = "services"
+
+var (
+	errParodusNotStarted = errors.New("parodus is not started")
+	errNotCRUD           = errors.New("parodus only answers CRUD requests")
+)
+
+// serviceStatus is what parodus reports about a registered local service.
+type serviceStatus struct {
+	URL       string    `json:"url"`
+	LastAlive time.Time `json:"last_alive"`
+	Queued    int       `json:"queued"`
+	Dropped   uint64    `json:"dropped"`
+}
+
+// selfHandler answers the CRUD requests for parodus itself: the device tags
+// and the state of the local services. The upstream connection hands it the
+// cloud requests for parodus before looking at the registry, so no service
+// can shadow it.
+//
+//	<device>/parodus/services  the registered services, read only
+type selfHandler struct {
+	parodus *Parodus
+}
+
+// ProvideSelfHandler creates the handler StartParodus attaches itself to.
+func ProvideSelfHandler() *selfHandler {
+	return &selfHandler{}
+}
+
+// Matches reports whether the destination is parodus itself.
+func (h *selfHandler) Matches(destination string) bool {
+	return localServiceName(destination) == ParodusServiceName
+}
+
+// HandleMessage answers a CRUD request for parodus itself. A request and
+// response is refused with a 405, anything else, like an event, is ignored.
+func (h *selfHandler) HandleMessage(msg *wrp.Message) *wrp.Message {
+	switch msg.Type {
+	case wrp.CreateMessageType, wrp.RetrieveMessageType, wrp.UpdateMessageType, wrp.DeleteMessageType:
+	case wrp.SimpleRequestResponseMessageType:
+		return kratos.CreateErrorWRP(msg.TransactionUUID, msg.Source, msg.Destination, http.StatusMethodNotAllowed, errNotCRUD)
+	default:
+		return nil
+	}
+	if h.parodus == nil {
+		return kratos.CreateErrorWRP(msg.TransactionUUID, msg.Source, msg.Destination, http.StatusServiceUnavailable, errParodusNotStarted)
+	}
+	if !servicesTarget(msg.Destination) {
+		return h.parodus.tags.HandleMessage(msg)
+	}
+	if msg.Type != wrp.RetrieveMessageType {
+		return crudResponse(msg, http.StatusMethodNotAllowed, errorPayload("services are read only"))
+	}
+	payload, err := json.Marshal(h.parodus.serviceStatus())
+	if err != nil {
+		return crudResponse(msg, http.StatusInternalServerError, errorPayload(err.Error()))
+	}
+	return crudResponse(msg, http.StatusOK, payload)
+}
+
+// Close is part of kratos.DownstreamHandler.
+func (h *selfHandler) Close() {}
+
+// serviceStatus reports on every registered service, by name.
+func (p *Parodus) serviceStatus() map[string]serviceStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := make(map[string]serviceStatus, len(p.services))
+	for name, service := range p.services {
+		status[name] = serviceStatus{
+			URL:       service.URL,
+			LastAlive: service.LastAlive,
+			Queued:    service.Queued(),
+			Dropped:   service.Dropped(),
+		}
+	}
+	return status
+}
+
+// servicesTarget reports whether the destination is the state of the
+// services, like mac:112233445566/parodus/services.
+func servicesTarget(destination string) bool {
+	parts := localPath(strings.TrimSuffix(destination, "/"))
+	return len(parts) == 2 && parts[0] == ParodusServiceName && parts[1] == ServicesPath
+}
@@ -0,0 +1,481 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+// FsyncPolicy decides when spooled messages are flushed to disk.
+type FsyncPolicy string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"
+	FsyncInterval FsyncPolicy = "interval"
+	FsyncNever    FsyncPolicy = "never"
+)
+
+const (
+	spoolSegmentSuffix = ".seg"
+
+	// The largest segment file, before a new one is started.
+	spoolSegmentSize = 1 << 20
+
+	// How often the active segment is synced with the interval fsync policy,
+	// when something was written to it. Segments are always synced when they
+	// are closed.
+	spoolSyncInterval = time.Second
+
+	// Every record is a big endian length and CRC32 followed by the msgpack
+	// encoded message.
+	spoolRecordHeaderSize = 8
+
+	// Anything longer is treated as a damaged length.
+	maxSpoolRecordSize = 64 << 20
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt spool record")
+)
+
+// SpoolConfig configures the on-disk spool for upstream events.
+type SpoolConfig struct {
+	Dir     string
+	MaxSize int64
+	Fsync   FsyncPolicy
+	Events  *regexp.Regexp
+}
+
+// spool is an on-disk queue of upstream events that must survive a restart.
+// Messages are appended to numbered segment files and replayed, oldest first,
+// on the next successful connection. A segment is removed once all of its
+// messages have been sent, so delivery is at least once. When the spool grows
+// past its size cap the oldest segment is dropped.
+type spool struct {
+	config SpoolConfig
+	logger *zap.Logger
+
+	lock       sync.Mutex
+	segments   []*spoolSegment
+	nextID     uint64
+	size       int64
+	count      int
+	readOffset int64
+	readCount  int
+	peekedSize int64
+	active     *os.File
+	dirty      bool
+	dropped    uint64
+
+	stopSync    chan struct{}
+	syncStopped chan struct{}
+	closeSync   sync.Once
+}
+
+type spoolSegment struct {
+	path  string
+	size  int64
+	count int
+}
+
+// openSpool opens the spool directory, recovering segments left by a previous
+// run. A partially written record at the end of a segment, from a crash or
+// power loss, is truncated.
+func openSpool(config SpoolConfig, logger *zap.Logger) (*spool, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", SpoolDirKeyName, err)
+	}
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", SpoolDirKeyName, err)
+	}
+
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	s := &spool{
+		config: config,
+		logger: logger,
+		nextID: 1,
+	}
+	for _, id := range ids {
+		segment, err := s.recoverSegment(s.segmentPath(id))
+		if err != nil {
+			return nil, err
+		}
+		s.nextID = id + 1
+		if segment.count == 0 {
+			os.Remove(segment.path)
+			continue
+		}
+		s.segments = append(s.segments, segment)
+		s.size += segment.size
+		s.count += segment.count
+	}
+	if s.count > 0 {
+		logger.Info("recovered spooled messages", zap.Int("messages", s.count), zap.Int64("bytes", s.size))
+	}
+	if config.Fsync == FsyncInterval {
+		s.stopSync = make(chan struct{})
+		s.syncStopped = make(chan struct{})
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// syncLoop syncs the active segment every spoolSyncInterval, so the last
+// events are on disk even when nothing else is appended.
+func (s *spool) syncLoop() {
+	defer close(s.syncStopped)
+	ticker := time.NewTicker(spoolSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopSync:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.dirty && s.active != nil {
+				if err := s.active.Sync(); err != nil {
+					s.logger.Error("failed to sync spool segment", zap.Error(err))
+				} else {
+					s.dirty = false
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *spool) segmentPath(id uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", id, spoolSegmentSuffix))
+}
+
+func (s *spool) recoverSegment(path string) (*spoolSegment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segment := &spoolSegment{path: path}
+	for {
+		_, n, err := readRecord(file, segment.size)
+		if err != nil {
+			break
+		}
+		segment.size += n
+		segment.count++
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > segment.size {
+		s.logger.Warn("truncating damaged spool segment", zap.String("segment", path),
+			zap.Int64("from", info.Size()), zap.Int64("to", segment.size))
+		if err := file.Truncate(segment.size); err != nil {
+			return nil, err
+		}
+		if err := file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return segment, nil
+}
+
+// Accepts reports whether the message belongs in the spool.
+func (s *spool) Accepts(msg *wrp.Message) bool {
+	return msg.Type == wrp.SimpleEventMessageType && s.config.Events.MatchString(msg.Destination)
+}
+
+// Len returns the number of spooled messages waiting to be sent.
+func (s *spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.count
+}
+
+// Dropped returns the number of messages lost to the size cap.
+func (s *spool) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// Append writes the message to the end of the spool.
+func (s *spool) Append(msg *wrp.Message) error {
+	var data []byte
+	if err := wrp.NewEncoderBytes(&data, wrp.Msgpack).Encode(msg); err != nil {
+		return err
+	}
+	record := make([]byte, spoolRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[spoolRecordHeaderSize:], data)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.openActive(int64(len(record))); err != nil {
+		return err
+	}
+	segment := s.segments[len(s.segments)-1]
+	if _, err := s.active.Write(record); err != nil {
+		// drop whatever part of the record made it to the file
+		s.active.Truncate(segment.size)
+		return err
+	}
+	segment.size += int64(len(record))
+	segment.count++
+	s.size += int64(len(record))
+	s.count++
+
+	switch s.config.Fsync {
+	case FsyncAlways:
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+	case FsyncInterval:
+		s.dirty = true
+	}
+
+	s.enforceMaxSize()
+	return nil
+}
+
+// openActive makes sure the newest segment is open for appending and has room
+// for another record, starting a new segment when it does not.
+func (s *spool) openActive(recordSize int64) error {
+	if len(s.segments) > 0 {
+		segment := s.segments[len(s.segments)-1]
+		if segment.size+recordSize <= s.segmentSize() || segment.count == 0 {
+			if s.active != nil {
+				return nil
+			}
+			file, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return err
+			}
+			s.active = file
+			return nil
+		}
+	}
+
+	if err := s.closeActive(); err != nil {
+		return err
+	}
+	path := s.segmentPath(s.nextID)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.active = file
+	s.segments = append(s.segments, &spoolSegment{path: path})
+	return syncDir(s.config.Dir)
+}
+
+func (s *spool) segmentSize() int64 {
+	if size := s.config.MaxSize / 4; size > 0 && size < spoolSegmentSize {
+		return size
+	}
+	return spoolSegmentSize
+}
+
+func (s *spool) closeActive() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Sync()
+	if closeErr := s.active.Close(); err == nil {
+		err = closeErr
+	}
+	s.active = nil
+	s.dirty = false
+	return err
+}
+
+// enforceMaxSize drops the oldest segments while the spool is over its cap.
+// The segment being appended to is always kept.
+func (s *spool) enforceMaxSize() {
+	for s.config.MaxSize > 0 && s.size > s.config.MaxSize && len(s.segments) > 1 {
+		segment := s.segments[0]
+		lost := segment.count
+		if s.readOffset > 0 {
+			// some of this segment was already sent
+			lost = s.countFrom(segment, s.readOffset)
+		}
+		s.removeOldest()
+		s.dropped += uint64(lost)
+		s.count -= lost
+		s.logger.Warn("spool is full, dropped the oldest segment", zap.String("segment", segment.path),
+			zap.Int("messages", lost), zap.Uint64("dropped", s.dropped))
+	}
+}
+
+// dropDamaged drops what is left of the oldest segment after a read error.
+func (s *spool) dropDamaged(err error) {
+	segment := s.segments[0]
+	lost := segment.count - s.readCount
+	s.removeOldest()
+	s.dropped += uint64(lost)
+	s.count -= lost
+	s.logger.Error("dropped damaged spool segment", zap.String("segment", segment.path), zap.Error(err),
+		zap.Int("messages", lost), zap.Uint64("dropped", s.dropped))
+}
+
+func (s *spool) countFrom(segment *spoolSegment, offset int64) int {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	count := 0
+	for offset < segment.size {
+		_, n, err := readRecord(file, offset)
+		if err != nil {
+			break
+		}
+		offset += n
+		count++
+	}
+	return count
+}
+
+func (s *spool) removeOldest() {
+	segment := s.segments[0]
+	if len(s.segments) == 1 {
+		s.closeActive()
+	}
+	if err := os.Remove(segment.path); err != nil {
+		s.logger.Error("failed to remove spool segment", zap.String("segment", segment.path), zap.Error(err))
+	}
+	s.segments = s.segments[1:]
+	s.size -= segment.size
+	s.readOffset = 0
+	s.readCount = 0
+	s.peekedSize = 0
+}
+
+// Peek returns the oldest spooled message, or nil when the spool is empty.
+// When the oldest segment cannot be read the rest of it is dropped, as the
+// size of the damaged record, and so where the next one starts, is unknown.
+func (s *spool) Peek() (*wrp.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.count == 0 || len(s.segments) == 0 {
+		return nil, nil
+	}
+	segment := s.segments[0]
+	file, err := os.Open(segment.path)
+	if err != nil {
+		s.dropDamaged(err)
+		return nil, err
+	}
+	defer file.Close()
+
+	data, n, err := readRecord(file, s.readOffset)
+	if err != nil {
+		s.dropDamaged(err)
+		return nil, err
+	}
+	var msg wrp.Message
+	if err := wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg); err != nil {
+		s.peekedSize = n
+		return nil, err
+	}
+	s.peekedSize = n
+	return &msg, nil
+}
+
+// Pop removes the message returned by the last Peek. Segments are deleted once
+// every message in them has been popped.
+func (s *spool) Pop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.peekedSize == 0 || len(s.segments) == 0 {
+		return
+	}
+	s.readOffset += s.peekedSize
+	s.readCount++
+	s.peekedSize = 0
+	s.count--
+	if s.readOffset >= s.segments[0].size {
+		s.removeOldest()
+	}
+}
+
+// Close stops the periodic sync, then syncs and closes the segment being
+// appended to.
+func (s *spool) Close() error {
+	if s.stopSync != nil {
+		s.closeSync.Do(func() {
+			close(s.stopSync)
+			<-s.syncStopped
+		})
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closeActive()
+}
+
+// readRecord reads the record at offset, returning its data and full size.
+func readRecord(r io.ReaderAt, offset int64) ([]byte, int64, error) {
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxSpoolRecordSize {
+		return nil, 0, errCorruptRecord
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset+spoolRecordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptRecord
+	}
+	return data, spoolRecordHeaderSize + int64(length), nil
+}
+
+// syncDir makes a newly created segment file durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
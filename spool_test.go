@@ -0,0 +1,252 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+func newTestSpool(t *testing.T, maxSize int64) *spool {
+	return openTestSpool(t, t.TempDir(), maxSize, FsyncNever)
+}
+
+func openTestSpool(t *testing.T, dir string, maxSize int64, fsync FsyncPolicy) *spool {
+	s, err := openSpool(SpoolConfig{
+		Dir:     dir,
+		MaxSize: maxSize,
+		Fsync:   fsync,
+		Events:  regexp.MustCompile(".*"),
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func spoolEvent(i int) *wrp.Message {
+	return &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: fmt.Sprintf("event:%d", i)}
+}
+
+// corruptRecord flips a byte in the payload of the record at offset, so its
+// checksum no longer matches.
+func corruptRecord(t *testing.T, path string, offset int64) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset+spoolRecordHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, offset+spoolRecordHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolDropsDamagedSegment(t *testing.T) {
+	// small segments, so the events are spread over several of them
+	s := newTestSpool(t, 1024)
+	for i := 0; i < 12; i++ {
+		if err := s.Append(spoolEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(s.segments))
+	}
+	first := s.segments[0]
+
+	// read the first event, then damage the second
+	msg, err := s.Peek()
+	if err != nil || msg == nil || msg.Destination != "event:0" {
+		t.Fatalf("unexpected first event %v: %v", msg, err)
+	}
+	s.Pop()
+	corruptRecord(t, first.path, s.readOffset)
+
+	if _, err := s.Peek(); err == nil {
+		t.Fatal("expected an error reading the damaged record")
+	}
+	lost := first.count - 1
+	if got := s.Dropped(); got != uint64(lost) {
+		t.Fatalf("expected %d dropped, got %d", lost, got)
+	}
+	if got := s.Len(); got != 12-1-lost {
+		t.Fatalf("expected %d spooled, got %d", 12-1-lost, got)
+	}
+	if _, err := os.Stat(first.path); !os.IsNotExist(err) {
+		t.Fatalf("expected the damaged segment to be removed, got %v", err)
+	}
+
+	// the next segment picks up where the damaged one stopped
+	msg, err = s.Peek()
+	if err != nil || msg == nil || msg.Destination != fmt.Sprintf("event:%d", first.count) {
+		t.Fatalf("unexpected event after the damaged segment %v: %v", msg, err)
+	}
+}
+
+func TestReplaySkipsDamagedRecord(t *testing.T) {
+	conn, received := newTestTalaria(t)
+	buffers, err := parseBufferConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Upstream{
+		logger: zap.NewNop(),
+		buffer: newOutboundBuffer(buffers),
+		spool:  newTestSpool(t, 0),
+		conn:   conn,
+	}
+	for i := 0; i < 3; i++ {
+		if err := u.spool.Append(spoolEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptRecord(t, u.spool.segments[0].path, 0)
+
+	done := make(chan bool)
+	go func() { done <- u.flushHeld() }()
+	select {
+	case flushed := <-done:
+		if !flushed {
+			t.Fatal("expected the flush to succeed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay is stuck on the damaged record")
+	}
+	if n := u.spool.Len(); n != 0 {
+		t.Fatalf("expected an empty spool, got %d", n)
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected event %s from a damaged segment", msg.Destination)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// readSpool pops every spooled event and returns their destinations.
+func readSpool(t *testing.T, s *spool) []string {
+	var got []string
+	for {
+		msg, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			return got
+		}
+		got = append(got, msg.Destination)
+		s.Pop()
+	}
+}
+
+func TestSpoolReplaysAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1024, FsyncNever)
+	for i := 0; i < 12; i++ {
+		if err := s.Append(spoolEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// send the whole first segment, so it is gone when the spool is reopened
+	first := s.segments[0].count
+	for i := 0; i < first; i++ {
+		s.Peek()
+		s.Pop()
+	}
+	last := s.segments[len(s.segments)-1].path
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record cut short by a crash is dropped when the spool is reopened
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 42, 1, 2})
+	file.Close()
+
+	s = openTestSpool(t, dir, 1024, FsyncNever)
+	if got := s.Len(); got != 12-first {
+		t.Fatalf("expected %d recovered events, got %d", 12-first, got)
+	}
+	if err := s.Append(spoolEvent(12)); err != nil {
+		t.Fatal(err)
+	}
+	got := readSpool(t, s)
+	if len(got) != 13-first {
+		t.Fatalf("expected %d events, got %v", 13-first, got)
+	}
+	for i, destination := range got {
+		if want := fmt.Sprintf("event:%d", first+i); destination != want {
+			t.Fatalf("expected %s, got %v", want, got)
+		}
+	}
+}
+
+func TestSpoolDropsOldestSegmentWhenFull(t *testing.T) {
+	s := newTestSpool(t, 1024)
+	for i := 0; i < 100; i++ {
+		if err := s.Append(spoolEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+		if s.size > s.config.MaxSize {
+			t.Fatalf("spool grew to %d bytes, over its %d", s.size, s.config.MaxSize)
+		}
+	}
+	dropped := int(s.Dropped())
+	if dropped == 0 {
+		t.Fatal("expected the oldest events to be dropped")
+	}
+	if got := s.Len(); got != 100-dropped {
+		t.Fatalf("expected %d spooled, got %d", 100-dropped, got)
+	}
+
+	// the newest events are kept, in order
+	got := readSpool(t, s)
+	if len(got) != 100-dropped {
+		t.Fatalf("expected %d events, got %d", 100-dropped, len(got))
+	}
+	for i, destination := range got {
+		if want := fmt.Sprintf("event:%d", dropped+i); destination != want {
+			t.Fatalf("expected %s, got %s", want, destination)
+		}
+	}
+}
+
+func TestSpoolSyncsOnInterval(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 0, FsyncInterval)
+	if err := s.Append(spoolEvent(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing else is appended, the ticker syncs the event
+	deadline := time.Now().Add(3 * spoolSyncInterval)
+	for {
+		s.lock.Lock()
+		dirty := s.dirty
+		s.lock.Unlock()
+		if !dirty {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the spool was not synced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
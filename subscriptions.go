@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	libparodus "github.com/xmidt-org/go-parodus/client"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// eventSubscriptions holds the events local services want a copy of, by
+// service name.
+type eventSubscriptions struct {
+	lock          sync.Mutex
+	subscriptions map[string][]eventSubscription
+}
+
+type eventSubscription struct {
+	libparodus.Subscription
+	matcher *regexp.Regexp
+}
+
+func newEventSubscriptions() *eventSubscriptions {
+	return &eventSubscriptions{
+		subscriptions: make(map[string][]eventSubscription),
+	}
+}
+
+// Matches reports whether the destination is the subscriptions of the local
+// services.
+func (s *eventSubscriptions) Matches(destination string) bool {
+	return strings.Join(localPath(destination), "/") == libparodus.SubscriptionsDestination
+}
+
+// HandleMessage changes or lists the subscriptions of the service.
+func (s *eventSubscriptions) HandleMessage(service string, msg *wrp.Message) *wrp.Message {
+	if msg.Type == wrp.RetrieveMessageType {
+		payload, err := json.Marshal(s.List(service))
+		if err != nil {
+			return crudResponse(msg, http.StatusInternalServerError, errorPayload(err.Error()))
+		}
+		return crudResponse(msg, http.StatusOK, payload)
+	}
+	if msg.Type != wrp.CreateMessageType && msg.Type != wrp.DeleteMessageType {
+		return crudResponse(msg, http.StatusMethodNotAllowed, errorPayload("unsupported message type"))
+	}
+
+	var subscription libparodus.Subscription
+	if err := json.Unmarshal(msg.Payload, &subscription); err != nil || subscription.Pattern == "" {
+		return crudResponse(msg, http.StatusBadRequest, errorPayload("payload must be a JSON subscription with a pattern"))
+	}
+	if msg.Type == wrp.DeleteMessageType {
+		if !s.Remove(service, subscription) {
+			return crudResponse(msg, http.StatusNotFound, errorPayload("subscription not found"))
+		}
+		return crudResponse(msg, http.StatusOK, nil)
+	}
+	if err := s.Add(service, subscription); err != nil {
+		return crudResponse(msg, http.StatusBadRequest, errorPayload(err.Error()))
+	}
+	return crudResponse(msg, http.StatusCreated, nil)
+}
+
+// Add subscribes the service to the events matching the subscription.
+// Subscribing twice to the same pattern is the same as subscribing once.
+func (s *eventSubscriptions) Add(service string, subscription libparodus.Subscription) error {
+	expr := subscription.Pattern
+	if !subscription.Regex {
+		expr = globExpr(expr)
+	}
+	matcher, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, existing := range s.subscriptions[service] {
+		if existing.Subscription == subscription {
+			return nil
+		}
+	}
+	s.subscriptions[service] = append(s.subscriptions[service], eventSubscription{Subscription: subscription, matcher: matcher})
+	return nil
+}
+
+// Remove unsubscribes the service, reporting whether it was subscribed.
+func (s *eventSubscriptions) Remove(service string, subscription libparodus.Subscription) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subscriptions := s.subscriptions[service]
+	for i, existing := range subscriptions {
+		if existing.Subscription == subscription {
+			s.subscriptions[service] = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			if len(s.subscriptions[service]) == 0 {
+				delete(s.subscriptions, service)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveService forgets every subscription of a service that went away.
+func (s *eventSubscriptions) RemoveService(service string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscriptions, service)
+}
+
+// List returns the subscriptions of the service.
+func (s *eventSubscriptions) List(service string) []libparodus.Subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subscriptions := make([]libparodus.Subscription, 0, len(s.subscriptions[service]))
+	for _, subscription := range s.subscriptions[service] {
+		subscriptions = append(subscriptions, subscription.Subscription)
+	}
+	return subscriptions
+}
+
+// Subscribers returns the services with a subscription matching the event
+// destination.
+func (s *eventSubscriptions) Subscribers(destination string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var services []string
+	for service, subscriptions := range s.subscriptions {
+		for _, subscription := range subscriptions {
+			if subscription.matcher.MatchString(destination) {
+				services = append(services, service)
+				break
+			}
+		}
+	}
+	return services
+}
+
+// globExpr turns a glob into a regular expression matching the whole
+// destination.
+func globExpr(glob string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
@@ -0,0 +1,248 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/xmidt-org/webpa-common/v2/logging" // nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// ParodusServiceName is the service name parodus answers to itself.
+	ParodusServiceName = "parodus"
+
+	// TagsPath is the path, under the parodus service, of the device tags.
+	TagsPath = "tags"
+)
+
+// tagStore is the CRUD service for device tags built into parodus. Every tag
+// has a name and a JSON value. The tags are kept in a JSON file, when one is
+// configured, which is replaced atomically on every change.
+//
+//	<device>/parodus/tags         the full tag set
+//	<device>/parodus/tags/<name>  a single tag
+type tagStore struct {
+	path   string
+	logger log.Logger
+
+	lock sync.Mutex
+	tags map[string]json.RawMessage
+}
+
+func loadTagStore(path string, logger log.Logger) (*tagStore, error) {
+	t := &tagStore{
+		path:   path,
+		logger: logger,
+		tags:   make(map[string]json.RawMessage),
+	}
+	if path == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", CRUDFileKeyName, err)
+	}
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &t.tags); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", CRUDFileKeyName, path, err)
+		}
+	}
+	return t, nil
+}
+
+// HandleMessage answers a CRUD request for the tags.
+func (t *tagStore) HandleMessage(msg *wrp.Message) *wrp.Message {
+	name, collection, ok := tagsTarget(msg.Destination)
+	if !ok {
+		return crudResponse(msg, http.StatusNotFound, errorPayload("unknown path"))
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	switch msg.Type {
+	case wrp.RetrieveMessageType:
+		return t.retrieve(msg, name, collection)
+	case wrp.CreateMessageType, wrp.UpdateMessageType, wrp.DeleteMessageType:
+		previous := make(map[string]json.RawMessage, len(t.tags))
+		for k, v := range t.tags {
+			previous[k] = v
+		}
+		response := t.change(msg, name, collection)
+		if status := response.Status; status != nil && *status < 300 {
+			if err := t.save(); err != nil {
+				logging.Error(t.logger).Log(logging.MessageKey(), "failed to save tags", logging.ErrorKey(), err, "file", t.path)
+				t.tags = previous
+				return crudResponse(msg, http.StatusInternalServerError, errorPayload("failed to save tags"))
+			}
+		}
+		return response
+	default:
+		return crudResponse(msg, http.StatusMethodNotAllowed, errorPayload("unsupported message type"))
+	}
+}
+
+func (t *tagStore) retrieve(msg *wrp.Message, name string, collection bool) *wrp.Message {
+	if collection {
+		payload, err := json.Marshal(t.tags)
+		if err != nil {
+			return crudResponse(msg, http.StatusInternalServerError, errorPayload(err.Error()))
+		}
+		return crudResponse(msg, http.StatusOK, payload)
+	}
+	value, ok := t.tags[name]
+	if !ok {
+		return crudResponse(msg, http.StatusNotFound, errorPayload("tag not found"))
+	}
+	return crudResponse(msg, http.StatusOK, value)
+}
+
+// change applies a create, update or delete to the tags in memory.
+func (t *tagStore) change(msg *wrp.Message, name string, collection bool) *wrp.Message {
+	var tags map[string]json.RawMessage
+	if msg.Type != wrp.DeleteMessageType {
+		if collection {
+			if err := json.Unmarshal(msg.Payload, &tags); err != nil || tags == nil {
+				return crudResponse(msg, http.StatusBadRequest, errorPayload("payload must be a JSON object of tags"))
+			}
+			for tagName := range tags {
+				if !validTagName(tagName) {
+					return crudResponse(msg, http.StatusBadRequest, errorPayload("invalid tag name"))
+				}
+			}
+		} else if !json.Valid(msg.Payload) {
+			return crudResponse(msg, http.StatusBadRequest, errorPayload("payload must be a JSON value"))
+		}
+	}
+
+	_, exists := t.tags[name]
+	switch {
+	case msg.Type == wrp.CreateMessageType && collection:
+		for tagName := range tags {
+			if _, ok := t.tags[tagName]; ok {
+				return crudResponse(msg, http.StatusConflict, errorPayload("tag already exists: "+tagName))
+			}
+		}
+		for tagName, value := range tags {
+			t.tags[tagName] = value
+		}
+		return crudResponse(msg, http.StatusCreated, nil)
+	case msg.Type == wrp.CreateMessageType:
+		if exists {
+			return crudResponse(msg, http.StatusConflict, errorPayload("tag already exists"))
+		}
+		t.tags[name] = json.RawMessage(msg.Payload)
+		return crudResponse(msg, http.StatusCreated, nil)
+	case msg.Type == wrp.UpdateMessageType && collection:
+		t.tags = tags
+		return crudResponse(msg, http.StatusOK, nil)
+	case msg.Type == wrp.UpdateMessageType:
+		if !exists {
+			return crudResponse(msg, http.StatusNotFound, errorPayload("tag not found"))
+		}
+		t.tags[name] = json.RawMessage(msg.Payload)
+		return crudResponse(msg, http.StatusOK, nil)
+	case collection:
+		t.tags = make(map[string]json.RawMessage)
+		return crudResponse(msg, http.StatusOK, nil)
+	default:
+		if !exists {
+			return crudResponse(msg, http.StatusNotFound, errorPayload("tag not found"))
+		}
+		delete(t.tags, name)
+		return crudResponse(msg, http.StatusOK, nil)
+	}
+}
+
+func (t *tagStore) save() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.tags, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data)
+}
+
+// Close is part of kratos.DownstreamHandler. The tags are saved on every
+// change, so there is nothing left to do.
+func (t *tagStore) Close() {}
+
+// tagsTarget finds the tag a destination refers to, or whether it is the
+// full tag set.
+func tagsTarget(destination string) (name string, collection bool, ok bool) {
+	parts := localPath(destination)
+	if len(parts) < 2 || parts[0] != ParodusServiceName || parts[1] != TagsPath {
+		return "", false, false
+	}
+	switch {
+	case len(parts) == 2, len(parts) == 3 && parts[2] == "":
+		return "", true, true
+	case len(parts) == 3 && validTagName(parts[2]):
+		return parts[2], false, true
+	default:
+		return "", false, false
+	}
+}
+
+func validTagName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+func crudResponse(msg *wrp.Message, status int64, payload []byte) *wrp.Message {
+	response := &wrp.Message{
+		Type:            msg.Type,
+		Source:          msg.Destination,
+		Destination:     msg.Source,
+		TransactionUUID: msg.TransactionUUID,
+		Payload:         payload,
+	}
+	if len(payload) > 0 {
+		response.ContentType = "application/json"
+	}
+	response.SetStatus(status)
+	return response
+}
+
+func errorPayload(message string) []byte {
+	payload, _ := json.Marshal(map[string]string{"err": message})
+	return payload
+}
+
+// writeFileAtomic replaces the file with data, so readers and crashes only
+// ever see the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
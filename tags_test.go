@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestTagStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		msgType     wrp.MessageType
+		destination string
+		payload     string
+		status      int64
+		tags        string
+	}{
+		{"retrieve all", wrp.RetrieveMessageType, "mac:112233445566/parodus/tags", "", http.StatusOK, `{"region":"eu"}`},
+		{"retrieve all with a trailing slash", wrp.RetrieveMessageType, "parodus/tags/", "", http.StatusOK, `{"region":"eu"}`},
+		{"retrieve one", wrp.RetrieveMessageType, "mac:112233445566/parodus/tags/region", "", http.StatusOK, `{"region":"eu"}`},
+		{"retrieve missing", wrp.RetrieveMessageType, "parodus/tags/model", "", http.StatusNotFound, `{"region":"eu"}`},
+		{"create one", wrp.CreateMessageType, "parodus/tags/model", `"xb7"`, http.StatusCreated, `{"model":"xb7","region":"eu"}`},
+		{"create existing", wrp.CreateMessageType, "parodus/tags/region", `"us"`, http.StatusConflict, `{"region":"eu"}`},
+		{"create many", wrp.CreateMessageType, "parodus/tags", `{"model":"xb7","tier":1}`, http.StatusCreated, `{"model":"xb7","region":"eu","tier":1}`},
+		{"create many with an existing", wrp.CreateMessageType, "parodus/tags", `{"model":"xb7","region":"us"}`, http.StatusConflict, `{"region":"eu"}`},
+		{"update one", wrp.UpdateMessageType, "parodus/tags/region", `"us"`, http.StatusOK, `{"region":"us"}`},
+		{"update missing", wrp.UpdateMessageType, "parodus/tags/model", `"xb7"`, http.StatusNotFound, `{"region":"eu"}`},
+		{"replace all", wrp.UpdateMessageType, "parodus/tags", `{"model":"xb7"}`, http.StatusOK, `{"model":"xb7"}`},
+		{"delete one", wrp.DeleteMessageType, "parodus/tags/region", "", http.StatusOK, `{}`},
+		{"delete missing", wrp.DeleteMessageType, "parodus/tags/model", "", http.StatusNotFound, `{"region":"eu"}`},
+		{"delete all", wrp.DeleteMessageType, "parodus/tags", "", http.StatusOK, `{}`},
+		{"bad value", wrp.CreateMessageType, "parodus/tags/model", `xb7`, http.StatusBadRequest, `{"region":"eu"}`},
+		{"bad tag set", wrp.UpdateMessageType, "parodus/tags", `["xb7"]`, http.StatusBadRequest, `{"region":"eu"}`},
+		{"nested tag", wrp.RetrieveMessageType, "parodus/tags/region/city", "", http.StatusNotFound, `{"region":"eu"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tags.json")
+			if err := os.WriteFile(path, []byte(`{"region":"eu"}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			store, err := loadTagStore(path, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response := store.HandleMessage(&wrp.Message{Type: test.msgType, TransactionUUID: "tags", Source: "dns:webpa.example.com",
+				Destination: test.destination, Payload: []byte(test.payload)})
+			if response.Status == nil || *response.Status != test.status {
+				t.Fatalf("expected a %d, got %+v", test.status, response)
+			}
+			if response.Type != test.msgType || response.TransactionUUID != "tags" || response.Destination != "dns:webpa.example.com" {
+				t.Fatalf("unexpected response %+v", response)
+			}
+
+			// the file always holds the tags in memory
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tags := range []json.RawMessage{data, mustMarshalTags(t, store.tags)} {
+				if !sameJSON(t, tags, []byte(test.tags)) {
+					t.Fatalf("expected tags %s, got %s", test.tags, tags)
+				}
+			}
+		})
+	}
+}
+
+func mustMarshalTags(t *testing.T, tags map[string]json.RawMessage) []byte {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON compares two JSON documents, whatever their layout and key order.
+func sameJSON(t *testing.T, a []byte, b []byte) bool {
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	xs, _ := json.Marshal(x)
+	ys, _ := json.Marshal(y)
+	return string(xs) == string(ys)
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// The maximum time the token script may run.
+	tokenScriptTimeout = 30 * time.Second
+
+	// A token is refreshed once it is this close to expiring.
+	tokenExpiryMargin = time.Minute
+)
+
+var (
+	errEmptyToken = errors.New("token script returned an empty token")
+)
+
+// tokenSource acquires the bearer token sent to talaria by running a device
+// provided script, like the C parodus token acquisition script. The script is
+// called with the serial number and MAC address and must print the token.
+type tokenSource struct {
+	script string
+	args   []string
+	logger *zap.Logger
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newTokenSource(config Config, logger *zap.Logger) *tokenSource {
+	if config.TokenScript == "" {
+		return nil
+	}
+	return &tokenSource{
+		script: config.TokenScript,
+		args:   []string{config.HardwareSerialNumber, config.HardwareMAC},
+		logger: logger,
+	}
+}
+
+// Token returns the current token, running the script when there is no token
+// yet or it is about to expire.
+func (t *tokenSource) Token(ctx context.Context) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token != "" && (t.expires.IsZero() || time.Now().Add(tokenExpiryMargin).Before(t.expires)) {
+		return t.token, nil
+	}
+
+	token, err := t.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	t.expires = tokenExpiry(token)
+	t.logger.Info("acquired auth token", zap.Time("expires", t.expires))
+	return t.token, nil
+}
+
+// Invalidate drops the current token so the next call to Token runs the
+// script again. It is called when talaria rejects the token.
+func (t *tokenSource) Invalidate() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.token = ""
+	t.expires = time.Time{}
+}
+
+func (t *tokenSource) acquire(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, tokenScriptTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.script, t.args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token script %s failed: %w: %s", t.script, err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(string(output))
+	if token == "" {
+		return "", errEmptyToken
+	}
+	return token, nil
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it. A zero time
+// is returned when the token is not a JWT or has no expiry.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil || exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
+}
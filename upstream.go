@@ -5,58 +5,855 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/xmidt-org/kratos" // nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
 
-func StartUpstreamConnection(config Config, lc fx.Lifecycle, logger *zap.Logger) (kratos.Client, error) {
+const (
+	// Time allowed to write a message to talaria.
+	writeWait = 10 * time.Second
+
+	// The number of consecutive ping misses before the connection is considered broken.
+	maxPingMiss = 3
+
+	// The starting delay of the reconnect backoff.
+	baseBackoff = time.Second
+
+	// How long a connection has to stay up before the backoff starts over.
+	// Talaria dropping connections right after accepting them, or draining
+	// every device at once, must not make devices redial without a delay.
+	stableConnection = time.Minute
+
+	// The maximum number of redirects followed during a handshake.
+	maxRedirects = 10
+
+	// How often the interface is checked for the connection's address.
+	networkCheckInterval = 30 * time.Second
+
+	// How often talaria is pinged to measure the round trip time.
+	pingRTTInterval = 30 * time.Second
+)
+
+var (
+	errNotConnected = errors.New("not connected to talaria")
+)
+
+// Upstream maintains the websocket connection to talaria. It implements
+// kratos.Client so it can be used in place of a single kratos connection, but
+// will redial talaria whenever the connection breaks. The HandlerRegistry
+// outlives every individual connection, so registered services stay attached.
+type Upstream struct {
+	config    Config
+	logger    *zap.Logger
+	registry  kratos.HandlerRegistry
+	dialer    *websocket.Dialer
+	tokens    *tokenSource
+	endpoints []EndpointResolver
+	authorize authorizer
+	requests  *upstreamRequests
+	self      *selfHandler
+
+	lock     sync.RWMutex
+	conn     *websocket.Conn
+	hostname string
+
+	// talariaURL is the url petasos last redirected us to, and active is
+	// the priority of the xmidt endpoint in use. They are only used by the
+	// connection goroutine.
+	talariaURL string
+	active     int
+
+	writeLock    sync.Mutex
+	sendLock     sync.Mutex
+	buffer       *outboundBuffer
+	spool        *spool
+	reasons      *closeReason
+	connectivity *Connectivity
+	downstream   chan *wrp.Message
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+func StartUpstreamConnection(config Config, endpoints []EndpointResolver, connectivity *Connectivity, requests *upstreamRequests,
+	self *selfHandler, lc fx.Lifecycle, logger *zap.Logger) (kratos.Client, error) {
 	queueConfig := kratos.QueueConfig{
 		MaxWorkers: 5,
 		Size:       100,
 	}
 
-	client, err := kratos.NewClient(kratos.ClientConfig{
-		DeviceName:           config.DeviceID,
-		FirmwareName:         config.FirmwareName,
-		ModelName:            config.HardwareModel,
-		Manufacturer:         config.HardwareManufacturer,
-		DestinationURL:       config.URL,
-		OutboundQueue:        queueConfig,
-		WRPEncoderQueue:      queueConfig,
-		WRPDecoderQueue:      queueConfig,
-		HandlerRegistryQueue: queueConfig,
-		HandleMsgQueue:       queueConfig,
-		Handlers:             []kratos.HandlerConfig{},
-		HandlePingMiss: func() error {
-			logger.Error("msg", zap.Any("error", "Ping Miss"))
-			// TODO: handle reconnect
-			return nil
-		},
-		ClientLogger: logger,
-		PingConfig: kratos.PingConfig{
-			PingWait:    time.Second * time.Duration(config.PingTimeout),
-			MaxPingMiss: 3,
-		},
-	})
+	registry, err := kratos.NewHandlerRegistry(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(config, logger)
+	if err != nil {
+		logger.Error("failed to create upstream dialer", zap.Error(err))
+		return nil, err
+	}
+
+	authorize, err := newAuthorizer(config, logger)
 	if err != nil {
-		logger.Error("failed to create client", zap.Error(err))
-		if client != nil {
-			closeErr := client.Close()
-			logger.Info("failed to close bad client", zap.Error(closeErr))
+		logger.Error("failed to create authorization policies", zap.Error(err))
+		return nil, err
+	}
+
+	var events *spool
+	if config.Spool.Dir != "" {
+		if events, err = openSpool(config.Spool, logger); err != nil {
+			logger.Error("failed to open spool", zap.Error(err))
+			return nil, err
 		}
 	}
 
-	logger.Info("kratos client created")
+	upstream := &Upstream{
+		config:       config,
+		logger:       logger,
+		registry:     registry,
+		dialer:       dialer,
+		tokens:       newTokenSource(config, logger),
+		endpoints:    endpoints,
+		authorize:    authorize,
+		requests:     requests,
+		self:         self,
+		active:       -1,
+		buffer:       newOutboundBuffer(config.OutboundBuffer),
+		spool:        events,
+		reasons:      loadCloseReason(config.CloseReasonFile, logger),
+		connectivity: connectivity,
+		downstream:   make(chan *wrp.Message, queueConfig.Size),
+		done:         make(chan struct{}),
+	}
+
+	connectivity.SetCloseReason(upstream.reasons.Get())
+
+	logger.Info("upstream connection created")
 	lc.Append(fx.Hook{
 		OnStart: func(context context.Context) error {
+			upstream.wg.Add(queueConfig.MaxWorkers + 1)
+			for i := 0; i < queueConfig.MaxWorkers; i++ {
+				go upstream.handleDownstream()
+			}
+			go upstream.maintainConnection()
 			return nil
 		},
 		OnStop: func(context context.Context) error {
-			return client.Close()
+			return upstream.Close()
 		},
 	})
-	return client, nil
+	return upstream, nil
+}
+
+// Hostname provides the host of the talaria we are currently connected to.
+func (u *Upstream) Hostname() string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.hostname
+}
+
+// HandlerRegistry returns the registry shared by every connection.
+func (u *Upstream) HandlerRegistry() kratos.HandlerRegistry {
+	return u.registry
+}
+
+// Send writes the message to talaria. While talaria is unreachable, or older
+// messages are still waiting to be flushed, the message is buffered instead.
+// Events selected for the spool are kept on disk rather than in memory. A
+// message sent while another one is being written is held the same way, so
+// callers never wait on a slow write; whoever writes next flushes it.
+func (u *Upstream) Send(message *wrp.Message) {
+	if !u.sendLock.TryLock() {
+		u.hold(message)
+		u.drain()
+		return
+	}
+	u.send(message)
+	u.sendLock.Unlock()
+	u.drain()
+}
+
+// send writes the message, or holds it when it has to wait. The caller holds
+// sendLock.
+func (u *Upstream) send(message *wrp.Message) {
+	if u.spool != nil && u.spool.Accepts(message) {
+		if u.spool.Len() == 0 && u.write(message) == nil {
+			return
+		}
+		u.hold(message)
+		return
+	}
+
+	if u.buffer.Len() == 0 {
+		err := u.write(message)
+		if err == nil {
+			return
+		}
+		if err != errNotConnected {
+			u.logger.Error("failed to send message upstream, buffering it", zap.Error(err),
+				zap.String("destination", message.Destination), zap.String("transaction_uuid", message.TransactionUUID))
+		}
+	}
+	u.hold(message)
+}
+
+// hold keeps the message in the spool or the buffer until it is flushed.
+func (u *Upstream) hold(message *wrp.Message) {
+	if u.spool != nil && u.spool.Accepts(message) {
+		err := u.spool.Append(message)
+		if err == nil {
+			return
+		}
+		u.logger.Error("failed to spool message, buffering it in memory", zap.Error(err),
+			zap.String("destination", message.Destination))
+	}
+	if dropped := u.buffer.Push(message); dropped > 0 {
+		u.logger.Warn("outbound buffer full, dropped a message",
+			zap.Stringer("qos", message.QualityOfService.Level()), zap.Uint64("dropped", dropped))
+	}
+}
+
+// drain flushes the messages held while another one was being written. It
+// only flushes when nobody else is writing; the writer drains again once it
+// is done, so nothing held is left behind.
+func (u *Upstream) drain() {
+	for u.holding() && u.connected() && u.sendLock.TryLock() {
+		flushed := u.flushHeld()
+		u.sendLock.Unlock()
+		if !flushed {
+			return
+		}
+	}
+}
+
+func (u *Upstream) holding() bool {
+	return (u.spool != nil && u.spool.Len() > 0) || u.buffer.Len() > 0
+}
+
+func (u *Upstream) connected() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.conn != nil
+}
+
+// flush sends the spooled and buffered messages in order until there are none
+// left or the connection fails.
+func (u *Upstream) flush() {
+	if u.spool != nil && u.spool.Len() > 0 {
+		u.logger.Info("replaying spool", zap.Int("messages", u.spool.Len()), zap.Uint64("dropped", u.spool.Dropped()))
+	}
+	if u.buffer.Len() > 0 {
+		u.logger.Info("flushing outbound buffer", zap.Int("messages", u.buffer.Len()), zap.Any("dropped", u.buffer.Dropped()))
+	}
+	u.sendLock.Lock()
+	flushed := u.flushHeld()
+	u.sendLock.Unlock()
+	if flushed {
+		u.drain()
+	}
+}
+
+// flushHeld sends the spooled messages, oldest first, then the buffered ones,
+// reporting whether all of them were sent. The caller holds sendLock.
+func (u *Upstream) flushHeld() bool {
+	if u.spool != nil {
+		for {
+			message, err := u.spool.Peek()
+			if err != nil {
+				// an undecodable record is skipped, a damaged segment has
+				// already been dropped by the spool
+				u.logger.Error("skipping unreadable spool record", zap.Error(err))
+				u.spool.Pop()
+				continue
+			}
+			if message == nil {
+				break
+			}
+			if err := u.write(message); err != nil {
+				u.logger.Error("failed to replay spool", zap.Error(err), zap.Int("remaining", u.spool.Len()))
+				return false
+			}
+			u.spool.Pop()
+		}
+	}
+
+	for {
+		message := u.buffer.Peek()
+		if message == nil {
+			return true
+		}
+		if err := u.write(message); err != nil {
+			u.buffer.Release()
+			u.logger.Error("failed to flush outbound buffer", zap.Error(err), zap.Int("remaining", u.buffer.Len()))
+			return false
+		}
+		u.buffer.Pop()
+	}
+}
+
+// Close stops reconnecting, closes the current connection and closes every
+// registered handler.
+func (u *Upstream) Close() error {
+	var err error
+	u.once.Do(func() {
+		u.logger.Info("closing upstream connection")
+		u.setCloseReason(CloseReasonSIGTERM)
+		u.connectivity.Set(StateOffline, CloseReasonSIGTERM, "")
+		close(u.done)
+		u.lock.Lock()
+		if u.conn != nil {
+			err = u.conn.Close()
+		}
+		u.lock.Unlock()
+		u.wg.Wait()
+		u.registry.Close()
+		if u.spool != nil {
+			if spoolErr := u.spool.Close(); spoolErr != nil {
+				u.logger.Error("failed to close spool", zap.Error(spoolErr))
+			}
+		}
+		u.logger.Info("upstream connection closed")
+	})
+	return err
+}
+
+func (u *Upstream) write(message *wrp.Message) error {
+	var buffer []byte
+	if err := wrp.NewEncoderBytes(&buffer, wrp.Msgpack).Encode(message); err != nil {
+		return err
+	}
+
+	u.lock.RLock()
+	conn := u.conn
+	u.lock.RUnlock()
+	if conn == nil {
+		return errNotConnected
+	}
+
+	u.writeLock.Lock()
+	defer u.writeLock.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.BinaryMessage, buffer)
+}
+
+// maintainConnection dials talaria and redials with a jittered exponential
+// backoff, capped at MaxBackoff, every time the connection is lost.
+func (u *Upstream) maintainConnection() {
+	defer u.wg.Done()
+	b := newBackoff(baseBackoff, time.Duration(u.config.MaxBackoff)*time.Second)
+	var next *probe
+	for {
+		var conn *websocket.Conn
+		var err error
+		if next != nil {
+			conn, err = u.takeOver(next)
+			next = nil
+		} else {
+			u.connectivity.Set(StateConnecting, "", "")
+			conn, err = u.dial()
+		}
+		if err != nil {
+			if isCertError(err) {
+				u.setCloseReason(CloseReasonCertError)
+			}
+			delay := b.next()
+			u.logger.Error("failed to connect to talaria", zap.Error(err), zap.Duration("retry_in", delay))
+			select {
+			case <-u.done:
+				return
+			case <-time.After(delay):
+				continue
+			}
+		}
+
+		connected := time.Now()
+		var reason string
+		reason, next = u.run(conn)
+		if time.Since(connected) >= stableConnection {
+			b.reset()
+		}
+
+		select {
+		case <-u.done:
+			if next != nil {
+				next.conn.Close()
+			}
+			return
+		default:
+		}
+		u.setCloseReason(reason)
+		if next != nil {
+			// the probe connection is already up, so there is no need to
+			// wait or to go offline
+			continue
+		}
+		u.connectivity.Set(StateOffline, reason, "")
+		delay := b.next()
+		u.logger.Info("reconnecting to talaria", zap.String("reason", reason), zap.Duration("retry_in", delay))
+		select {
+		case <-u.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (u *Upstream) dial() (*websocket.Conn, error) {
+	if _, err := wrp.ParseDeviceID(u.config.DeviceID); err != nil {
+		return nil, err
+	}
+
+	headers, err := connectHeaders(u.config, u.reasons.Get())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := u.doneContext()
+	defer cancel()
+
+	// reconnect straight to the talaria we were last redirected to, and only
+	// go back through petasos when it stops answering
+	if u.talariaURL != "" {
+		conn, wsURL, err := u.connect(ctx, u.talariaURL, headers)
+		if err == nil {
+			return u.setConnection(conn, wsURL)
+		}
+		u.logger.Error("failed to reconnect to the last talaria, falling back to the configured url", zap.String("url", u.talariaURL), zap.Error(err))
+		u.talariaURL = ""
+	}
+
+	// try every xmidt endpoint in order of preference
+	var lastErr error
+	for priority, resolver := range u.endpoints {
+		endpoint, err := resolver.Endpoint(ctx)
+		if err == nil {
+			var conn *websocket.Conn
+			var wsURL string
+			conn, wsURL, err = u.connect(ctx, toWebsocketURL(endpoint), headers)
+			if err == nil {
+				if wsURL != toWebsocketURL(endpoint) {
+					u.talariaURL = wsURL
+				}
+				u.setActive(priority, endpoint)
+				return u.setConnection(conn, wsURL)
+			}
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		if priority < len(u.endpoints)-1 {
+			u.logger.Error("failed to connect to xmidt endpoint, failing over to the next one",
+				zap.Int("priority", priority), zap.String("url", endpoint), zap.Error(err))
+		}
+	}
+	return nil, lastErr
+}
+
+// setCloseReason records why the connection ended, for talaria on the next
+// handshake and for local cloud status queries.
+func (u *Upstream) setCloseReason(reason string) {
+	u.reasons.Set(reason)
+	u.connectivity.SetCloseReason(reason)
+}
+
+// doneContext returns a context that is cancelled when the upstream closes.
+func (u *Upstream) doneContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-u.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (u *Upstream) setActive(priority int, endpoint string) {
+	if priority != u.active {
+		u.logger.Info("active xmidt endpoint changed", zap.Int("priority", priority),
+			zap.String("url", endpoint), zap.Int("previous", u.active))
+	}
+	u.active = priority
+}
+
+// probe is a connection to the preferred xmidt endpoint, made while connected
+// to another one. Failing back takes it over, so the device is not seen going
+// online and offline once more on the preferred endpoint.
+type probe struct {
+	conn     *websocket.Conn
+	wsURL    string
+	endpoint string
+}
+
+// probePreferred connects to the most preferred xmidt endpoint, returning nil
+// while it is still unreachable. The handshake already tells talaria the
+// connection is a failback.
+func (u *Upstream) probePreferred() *probe {
+	headers, err := connectHeaders(u.config, CloseReasonFailback)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := u.doneContext()
+	defer cancel()
+
+	endpoint, err := u.endpoints[0].Endpoint(ctx)
+	if err != nil {
+		return nil
+	}
+	conn, wsURL, err := u.connect(ctx, toWebsocketURL(endpoint), headers)
+	if err != nil {
+		u.logger.Debug("preferred xmidt endpoint is still unreachable", zap.String("url", endpoint), zap.Error(err))
+		return nil
+	}
+	u.logger.Info("preferred xmidt endpoint is reachable again, failing back", zap.String("url", endpoint))
+	return &probe{conn: conn, wsURL: wsURL, endpoint: endpoint}
+}
+
+// takeOver makes the probe connection the upstream connection.
+func (u *Upstream) takeOver(p *probe) (*websocket.Conn, error) {
+	u.talariaURL = ""
+	if p.wsURL != toWebsocketURL(p.endpoint) {
+		u.talariaURL = p.wsURL
+	}
+	u.setActive(0, p.endpoint)
+	return u.setConnection(p.conn, p.wsURL)
+}
+
+// connect performs the handshake, acquiring a new auth token and trying once
+// more if talaria rejects the current one. The url that was finally dialed,
+// after any redirects, is returned.
+func (u *Upstream) connect(ctx context.Context, wsURL string, headers http.Header) (*websocket.Conn, string, error) {
+	conn, resp, finalURL, err := u.handshake(ctx, wsURL, headers)
+	if err == websocket.ErrBadHandshake && resp != nil && u.tokens != nil &&
+		(resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		u.logger.Info("talaria rejected the auth token, acquiring a new one", zap.Int("status", resp.StatusCode))
+		u.tokens.Invalidate()
+		conn, resp, finalURL, err = u.handshake(ctx, finalURL, headers)
+	}
+	if err == websocket.ErrBadHandshake && resp != nil {
+		err = fmt.Errorf("%w: %s", err, resp.Status)
+	}
+	return conn, finalURL, err
+}
+
+// handshake dials talaria with the current auth token, if there is one, and
+// follows up to maxRedirects redirects, as petasos answers with the talaria
+// to use.
+func (u *Upstream) handshake(ctx context.Context, wsURL string, headers http.Header) (*websocket.Conn, *http.Response, string, error) {
+	if u.tokens != nil {
+		token, err := u.tokens.Token(ctx)
+		if err != nil {
+			return nil, nil, wsURL, err
+		}
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, resp, err := u.dialer.DialContext(ctx, wsURL, headers)
+	for redirects := 0; err == websocket.ErrBadHandshake && resp != nil && isRedirect(resp.StatusCode); redirects++ {
+		if redirects >= maxRedirects {
+			return nil, resp, wsURL, fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		location, locErr := resp.Location()
+		if locErr != nil {
+			return nil, resp, wsURL, locErr
+		}
+		u.logger.Debug("following redirect", zap.String("from", wsURL), zap.String("to", location.String()))
+		wsURL = toWebsocketURL(location.String())
+		conn, resp, err = u.dialer.DialContext(ctx, wsURL, headers)
+	}
+	return conn, resp, wsURL, err
+}
+
+func (u *Upstream) setConnection(conn *websocket.Conn, wsURL string) (*websocket.Conn, error) {
+	hostname := wsURL
+	if parsed, err := url.Parse(wsURL); err == nil {
+		hostname = parsed.Hostname()
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	select {
+	case <-u.done:
+		conn.Close()
+		return nil, errNotConnected
+	default:
+	}
+	u.conn = conn
+	u.hostname = hostname
+	u.reasons.Connected()
+	u.connectivity.Set(StateOnline, "", wsURL)
+	u.logger.Info("connected to talaria", zap.String("url", wsURL))
+	return conn, nil
+}
+
+// run services a single connection until it fails, from a socket error, too
+// many missed pings or the interface losing the connection's address, or
+// until the preferred xmidt endpoint can be failed back to. The reason the
+// connection ended is returned, with the connection to fail back to.
+func (u *Upstream) run(conn *websocket.Conn) (string, *probe) {
+	pingWait := time.Second * time.Duration(u.config.PingTimeout)
+	if pingWait <= 0 {
+		pingWait = time.Minute
+	}
+
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(appData string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		u.writeLock.Lock()
+		defer u.writeLock.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeWait))
+	})
+	// our own pings carry the time they were sent
+	conn.SetPongHandler(func(appData string) error {
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			u.connectivity.SetPingRTT(time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+
+	var readErr error
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		readErr = u.read(conn)
+	}()
+	flushDone := make(chan struct{})
+	go func() {
+		defer close(flushDone)
+		u.flush()
+	}()
+
+	networkCheck := time.NewTicker(networkCheckInterval)
+	defer networkCheck.Stop()
+
+	rttCheck := time.NewTicker(pingRTTInterval)
+	defer rttCheck.Stop()
+	u.ping(conn)
+
+	var failback <-chan time.Time
+	if u.active > 0 && u.config.FailbackInterval > 0 {
+		ticker := time.NewTicker(time.Duration(u.config.FailbackInterval) * time.Second)
+		defer ticker.Stop()
+		failback = ticker.C
+	}
+	probed := make(chan *probe, 1)
+	probing := false
+	var next *probe
+
+	timer := time.NewTimer(pingWait)
+	defer timer.Stop()
+	misses := 0
+	reason := CloseReasonUnknown
+loop:
+	for {
+		select {
+		case <-u.done:
+			reason = CloseReasonSIGTERM
+			break loop
+		case <-readDone:
+			reason = CloseReasonSocketError
+			if _, ok := readErr.(*websocket.CloseError); ok {
+				reason = CloseReasonServerClose
+			}
+			break loop
+		case <-networkCheck.C:
+			if u.config.BindInterface && !hasLocalAddr(u.config.Interface, conn.LocalAddr()) {
+				u.logger.Error("interface no longer has the connection's address, dropping connection",
+					zap.String("interface", u.config.Interface), zap.Stringer("address", conn.LocalAddr()))
+				reason = CloseReasonNetworkChange
+				break loop
+			}
+		case <-rttCheck.C:
+			u.ping(conn)
+		case <-failback:
+			if !probing {
+				probing = true
+				go func() {
+					probed <- u.probePreferred()
+				}()
+			}
+		case next = <-probed:
+			probing = false
+			if next != nil {
+				reason = CloseReasonFailback
+				break loop
+			}
+		case <-pinged:
+			misses = 0
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(pingWait)
+		case <-timer.C:
+			misses++
+			u.logger.Error("ping miss", zap.Int("count", misses))
+			if misses >= maxPingMiss {
+				u.logger.Error("too many ping misses, dropping connection")
+				reason = CloseReasonPingMiss
+				break loop
+			}
+			timer.Reset(pingWait)
+		}
+	}
+
+	u.lock.Lock()
+	u.conn = nil
+	u.hostname = ""
+	u.lock.Unlock()
+	if err := conn.Close(); err != nil {
+		u.logger.Debug("failed to close connection", zap.Error(err))
+	}
+	<-readDone
+	<-flushDone
+	if probing {
+		// nobody takes over a probe that finishes now
+		go func() {
+			if late := <-probed; late != nil {
+				late.conn.Close()
+			}
+		}()
+	}
+	return reason, next
+}
+
+// ping sends talaria a ping to measure the round trip time.
+func (u *Upstream) ping(conn *websocket.Conn) {
+	u.writeLock.Lock()
+	defer u.writeLock.Unlock()
+	sent := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := conn.WriteControl(websocket.PingMessage, []byte(sent), time.Now().Add(writeWait)); err != nil {
+		u.logger.Debug("failed to ping talaria", zap.Error(err))
+	}
+}
+
+func (u *Upstream) read(conn *websocket.Conn) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-u.done:
+			default:
+				u.logger.Error("failed to read message", zap.Error(err))
+			}
+			return err
+		}
+
+		var msg wrp.Message
+		if err := wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg); err != nil {
+			u.logger.Error("failed to decode message", zap.Error(err))
+			continue
+		}
+		select {
+		case u.downstream <- &msg:
+		case <-u.done:
+			return nil
+		}
+	}
+}
+
+// handleDownstream hands messages from talaria to parodus itself or to the
+// registered handler for their destination and sends back any response. Requests have to pass the
+// authorization policies first, a rejected one is answered with a 403.
+func (u *Upstream) handleDownstream() {
+	defer u.wg.Done()
+	for {
+		select {
+		case <-u.done:
+			return
+		case msg := <-u.downstream:
+			if u.requests.IsRequest(msg) {
+				if err := u.authorize.Allow(*msg); err != nil {
+					u.logger.Warn("rejected request", zap.Error(err), zap.String("source", msg.Source),
+						zap.String("destination", msg.Destination), zap.Strings("partnerIDs", msg.PartnerIDs))
+					u.Send(kratos.CreateErrorWRP(msg.TransactionUUID, msg.Source, u.config.DeviceID, http.StatusForbidden, err))
+					continue
+				}
+			}
+			// parodus itself comes first, whatever the services are called
+			var handler kratos.DownstreamHandler = u.self
+			var err error
+			if !u.self.Matches(msg.Destination) {
+				handler, err = u.registry.GetHandler(msg.Destination)
+			}
+			if err != nil {
+				u.logger.Error("failed to get handler", zap.Error(err), zap.String("destination", msg.Destination))
+				u.Send(kratos.CreateErrorWRP(msg.TransactionUUID, msg.Source, u.config.DeviceID, http.StatusServiceUnavailable, err))
+				continue
+			}
+			if response := handler.HandleMessage(msg); response != nil {
+				u.Send(response)
+			}
+		}
+	}
+}
+
+// backoff computes exponentially increasing delays with equal jitter,
+// capped at max.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	if max < base {
+		max = base
+	}
+	return &backoff{base: base, max: max}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.base << uint(b.attempt); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempt++
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// toWebsocketURL makes sure the url's protocol is websocket.
+func toWebsocketURL(httpURL string) string {
+	if strings.HasPrefix(httpURL, "http") {
+		return "ws" + strings.TrimPrefix(httpURL, "http")
+	}
+	return httpURL
 }
@@ -0,0 +1,271 @@
+// SPDX-FileCopyrightText: 2025 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xmidt-org/kratos"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+// newTestTalaria starts a websocket server handing every message it reads to
+// received, and returns a connection to it.
+func newTestTalaria(t *testing.T) (*websocket.Conn, <-chan wrp.Message) {
+	received := make(chan wrp.Message, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg wrp.Message
+			if err := wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg); err == nil {
+				received <- msg
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, received
+}
+
+func TestSendDoesNotWaitForWrite(t *testing.T) {
+	conn, received := newTestTalaria(t)
+	buffers, err := parseBufferConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Upstream{
+		logger: zap.NewNop(),
+		buffer: newOutboundBuffer(buffers),
+		conn:   conn,
+	}
+
+	// another message is being written
+	u.sendLock.Lock()
+	sent := make(chan struct{})
+	go func() {
+		u.Send(&wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:first"})
+		u.Send(&wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:second"})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Send waited for the write in progress")
+	}
+	if n := u.buffer.Len(); n != 2 {
+		t.Fatalf("expected 2 held messages, got %d", n)
+	}
+
+	// the writer drains what was held once it is done
+	u.sendLock.Unlock()
+	u.drain()
+	for _, want := range []string{"event:first", "event:second"} {
+		select {
+		case msg := <-received:
+			if msg.Destination != want {
+				t.Fatalf("expected %s, got %s", want, msg.Destination)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not flushed", want)
+		}
+	}
+	if n := u.buffer.Len(); n != 0 {
+		t.Fatalf("expected an empty buffer, got %d", n)
+	}
+}
+
+func TestHandleDownstreamRoutesParodusFirst(t *testing.T) {
+	registry, err := kratos.NewHandlerRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// services whose names would match the parodus and other services'
+	// destinations as unanchored patterns
+	handlers := map[string]recordingHandler{}
+	for _, name := range []string{"tags", "parodus.*", "config", "config2"} {
+		handlers[name] = make(recordingHandler, 10)
+		if err := registry.Add(servicePattern(name), handlers[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffers, err := parseBufferConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Parodus{services: map[string]*Forwarder{}, tags: &tagStore{tags: map[string]json.RawMessage{"zone": json.RawMessage(`"eu"`)}}}
+	self := ProvideSelfHandler()
+	self.parodus = p
+	u := &Upstream{
+		logger:     zap.NewNop(),
+		registry:   registry,
+		requests:   ProvideUpstreamRequests(),
+		self:       self,
+		buffer:     newOutboundBuffer(buffers),
+		downstream: make(chan *wrp.Message, 10),
+		done:       make(chan struct{}),
+	}
+	u.wg.Add(1)
+	go u.handleDownstream()
+	defer func() {
+		close(u.done)
+		u.wg.Wait()
+	}()
+
+	// many rounds, as the registry walks a map in random order
+	for i := 0; i < 50; i++ {
+		u.downstream <- &wrp.Message{Type: wrp.RetrieveMessageType, TransactionUUID: "tags", Destination: "mac:112233445566/parodus/tags/zone"}
+		u.downstream <- &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "mac:112233445566/config2/changed"}
+		select {
+		case msg := <-handlers["config2"]:
+			if msg.Destination != "mac:112233445566/config2/changed" {
+				t.Fatalf("unexpected message for config2 %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("config2 did not get its event")
+		}
+	}
+	for name, handler := range handlers {
+		if name != "config2" && len(handler) > 0 {
+			t.Fatalf("%s got a message for another destination: %+v", name, <-handler)
+		}
+	}
+	if n := u.buffer.Len(); n != 50 {
+		t.Fatalf("expected 50 tag responses, got %d", n)
+	}
+	response := u.buffer.Peek()
+	if response.Status == nil || *response.Status != http.StatusOK || string(response.Payload) != `"eu"` {
+		t.Fatalf("unexpected tag response %+v", response)
+	}
+}
+
+// testEndpoint is a talaria that can refuse connections, keeping count of the
+// ones it accepted and of those still open.
+type testEndpoint struct {
+	url      string
+	up       int32
+	accepted int32
+	open     int32
+	reasons  chan string
+}
+
+func newTestEndpoint(t *testing.T, up bool) *testEndpoint {
+	e := &testEndpoint{reasons: make(chan string, 10)}
+	if up {
+		e.up = 1
+	}
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&e.up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(&e.accepted, 1)
+		atomic.AddInt32(&e.open, 1)
+		defer atomic.AddInt32(&e.open, -1)
+		e.reasons <- r.Header.Get("X-Midt-Last-Reconnect-Reason")
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	e.url = server.URL
+	return e
+}
+
+func TestFailbackKeepsProbeConnection(t *testing.T) {
+	preferred := newTestEndpoint(t, false)
+	secondary := newTestEndpoint(t, true)
+	buffers, err := parseBufferConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectivity := ProvideConnectivity()
+	u := &Upstream{
+		config: Config{
+			DeviceID:         "mac:112233445566",
+			FailbackInterval: 1,
+			MaxBackoff:       1,
+		},
+		logger:       zap.NewNop(),
+		dialer:       &websocket.Dialer{},
+		endpoints:    []EndpointResolver{staticResolver(preferred.url), staticResolver(secondary.url)},
+		active:       -1,
+		buffer:       newOutboundBuffer(buffers),
+		reasons:      loadCloseReason("", zap.NewNop()),
+		connectivity: connectivity,
+		downstream:   make(chan *wrp.Message, 10),
+		done:         make(chan struct{}),
+	}
+	u.wg.Add(1)
+	go u.maintainConnection()
+	defer func() {
+		close(u.done)
+		u.wg.Wait()
+	}()
+
+	select {
+	case <-secondary.reasons:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not fail over to the secondary endpoint")
+	}
+	for connectivity.Current().State != StateOnline {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := connectivity.Subscribe()
+	atomic.StoreInt32(&preferred.up, 1)
+
+	select {
+	case reason := <-preferred.reasons:
+		if reason != CloseReasonFailback {
+			t.Fatalf("expected the handshake to give %s as the reason, got %s", CloseReasonFailback, reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not fail back to the preferred endpoint")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&secondary.open) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&preferred.accepted); n != 1 {
+		t.Fatalf("expected the probe to be the only connection to the preferred endpoint, got %d", n)
+	}
+	if atomic.LoadInt32(&preferred.open) != 1 || atomic.LoadInt32(&secondary.open) != 0 {
+		t.Fatal("expected to be connected to the preferred endpoint only")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected connectivity change %s during the failback", event.State)
+	default:
+	}
+}